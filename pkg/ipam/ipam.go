@@ -2,229 +2,342 @@ package ipam
 
 import (
 	"fmt"
+	"math/big"
+	"math/rand"
 	"net"
-	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/klog"
 )
 
-// Manager - handles the addresses for each namespace/vip
-var Manager []ipManager
+// Family - the IP family of an address, an empty Family will match an address of any family
+type Family string
 
-// ipManager defines the mapping to a namespace and address pool
+const (
+	// IPv4 - matches only IPv4 addresses
+	IPv4 Family = "IPv4"
+	// IPv6 - matches only IPv6 addresses
+	IPv6 Family = "IPv6"
+)
+
+// Request - describes the address that is needed from a pool
+type Request struct {
+	// Family of the address, an empty Family will accept an address of any family
+	Family Family
+	// Strategy picks which of the free addresses is handed out
+	Strategy Strategy
+	// Key identifies the service the address is for (namespace/name)
+	Key string
+	// Owner is recorded against the address (the service UID), only an owner can release it
+	Owner string
+	// Quarantine holds back addresses released within the period, they are only handed out once no other address is free
+	Quarantine time.Duration
+	// Retention hands back the address last released by the service with the same Key, if it was released within the
+	// period and is still free
+	Retention time.Duration
+}
+
+// Allocator - handles the addresses of each named pool, it is safe for concurrent use
+type Allocator struct {
+	mu       sync.Mutex
+	managers map[string]*ipManager
+}
+
+// ipManager defines the mapping of a name to an address pool
 type ipManager struct {
-	namespace      string
-	cidr           string
-	ipRange        string
+	name           string
+	kind           poolKind
+	definition     string
 	addressManager map[string]bool
-	hosts          []string
-}
+	pool           *addressPool
+	rand           *rand.Rand
 
-// FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromRange(namespace, ipRange string) (string, error) {
+	// owners holds the owners of each address in use, an address is only freed once every owner has released it
+	owners map[string]map[string]bool
+	// released holds when addresses were last freed, for the pool's quarantine
+	released map[string]time.Time
+	// sticky holds the addresses released by each service (by key) and when
+	sticky map[string]map[string]time.Time
+}
 
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].ipRange != ipRange {
-				// If not rebuild the available hosts
-				ah, err := buildHostsFromRange(ipRange)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].hosts = ah
-			}
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].hosts {
-				// find a host that is marked false (i.e. unused)
-				if Manager[x].addressManager[Manager[x].hosts[y]] == false {
-					// Mark it to used
-					Manager[x].addressManager[Manager[x].hosts[y]] = true
-					return Manager[x].hosts[y], nil
-				}
-			}
-			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, ipRange)
+// NewAllocator - returns an Allocator with no address pools
+func NewAllocator() *Allocator {
+	return &Allocator{
+		managers: map[string]*ipManager{},
+	}
+}
 
+// manager - returns the manager for a pool, creating it if it doesn't exist (the lock must be held)
+func (a *Allocator) manager(name string) *ipManager {
+	m, ok := a.managers[name]
+	if !ok {
+		m = &ipManager{
+			name:           name,
+			addressManager: make(map[string]bool),
+			owners:         make(map[string]map[string]bool),
+			released:       make(map[string]time.Time),
+			sticky:         make(map[string]map[string]time.Time),
 		}
+		a.managers[name] = m
 	}
-	ah, err := buildHostsFromRange(ipRange)
-	if err != nil {
+	return m
+}
+
+// FindAvailableHostFromRange - will look through the range and the address manager and find a free address (if possible)
+func (a *Allocator) FindAvailableHostFromRange(name, ipRange string, req Request) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.manager(name)
+	if err := m.updatePool(rangePool, ipRange); err != nil {
 		return "", err
 	}
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace:      namespace,
-		addressManager: make(map[string]bool),
-		hosts:          ah,
-		ipRange:        ipRange,
+	return m.findAvailableHost(ipRange, req)
+}
+
+// FindAvailableHostFromCidr - will look through the cidr and the address manager and find a free address (if possible)
+func (a *Allocator) FindAvailableHostFromCidr(name, cidr string, req Request) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.manager(name)
+	if err := m.updatePool(cidrPool, cidr); err != nil {
+		return "", err
 	}
-	Manager = append(Manager, newManager)
+	return m.findAvailableHost(cidr, req)
+}
 
-	for x := range newManager.hosts {
-		if Manager[x].addressManager[newManager.hosts[x]] == false {
-			Manager[x].addressManager[newManager.hosts[x]] = true
-			return newManager.hosts[x], nil
-		}
+// ReserveHostFromRange - marks a specific address as used, it must be within the range (or one of its reservations)
+// and not already in use in any pool
+func (a *Allocator) ReserveHostFromRange(name, ipRange, address, owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.manager(name)
+	if err := m.updatePool(rangePool, ipRange); err != nil {
+		return err
 	}
-	return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, ipRange)
+	return a.reserveHost(m, ipRange, address, owner)
+}
+
+// ReserveHostFromCidr - marks a specific address as used, it must be within the cidr (or one of its reservations)
+// and not already in use in any pool
+func (a *Allocator) ReserveHostFromCidr(name, cidr, address, owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
+	m := a.manager(name)
+	if err := m.updatePool(cidrPool, cidr); err != nil {
+		return err
+	}
+	return a.reserveHost(m, cidr, address, owner)
 }
 
-// FindAvailableHostFromCidr - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromCidr(namespace, cidr string) (string, error) {
+// FindAvailableHostFromPool - will look through a pool of cidrs and ranges and find a free address (if possible)
+func (a *Allocator) FindAvailableHostFromPool(name, definition string, req Request) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].cidr != cidr {
-				// If not rebuild the available hosts
-				ah, err := buildHostsFromCidr(cidr)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].hosts = ah
-			}
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].hosts {
-				// find a host that is marked false (i.e. unused)
-				if Manager[x].addressManager[Manager[x].hosts[y]] == false {
-					// Mark it to used
-					Manager[x].addressManager[Manager[x].hosts[y]] = true
-					return Manager[x].hosts[y], nil
-				}
-			}
-			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, cidr)
+	m := a.manager(name)
+	if err := m.updatePool(mixedPool, definition); err != nil {
+		return "", err
+	}
+	return m.findAvailableHost(definition, req)
+}
 
-		}
+// ReserveHostFromPool - marks a specific address as used, it must be within the pool of cidrs and ranges (or one of
+// its reservations) and not already in use in any pool
+func (a *Allocator) ReserveHostFromPool(name, definition, address, owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.manager(name)
+	if err := m.updatePool(mixedPool, definition); err != nil {
+		return err
 	}
-	ah, err := buildHostsFromCidr(cidr)
+	return a.reserveHost(m, definition, address, owner)
+}
+
+// reserveHost - checks an address is in the manager's pool and unused, before marking it for the owner (the lock must
+// be held)
+func (a *Allocator) reserveHost(m *ipManager, definition, address, owner string) error {
+	address, err := NormalizeAddress(address)
 	if err != nil {
-		return "", err
+		return err
 	}
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace:      namespace,
-		addressManager: make(map[string]bool),
-		hosts:          ah,
-		cidr:           cidr,
+	if !m.pool.contains(address) && !m.pool.reserved(address) {
+		return fmt.Errorf("Address [%s] isn't available from [%s] range [%s]", address, m.name, definition)
 	}
-	Manager = append(Manager, newManager)
-
-	for x := range newManager.hosts {
-		if Manager[x].addressManager[newManager.hosts[x]] == false {
-			Manager[x].addressManager[newManager.hosts[x]] = true
-			return newManager.hosts[x], nil
+	// The owner already holds the address, as when a rebuilt service is synced again
+	if owner != "" && m.owners[address][owner] {
+		return nil
+	}
+	for _, other := range a.managers {
+		if other.addressManager[address] {
+			return fmt.Errorf("Address [%s] is already in use in pool [%s]", address, other.name)
 		}
 	}
-	return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, cidr)
-
+	m.mark(address, owner)
+	return nil
 }
 
-// ReleaseAddress - removes the mark on an address
-func ReleaseAddress(namespace, address string) error {
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			Manager[x].addressManager[address] = false
-			return nil
-		}
+// mark - marks an address as used by the owner
+func (m *ipManager) mark(address, owner string) {
+	m.addressManager[address] = true
+	delete(m.released, address)
+	if m.owners[address] == nil {
+		m.owners[address] = map[string]bool{}
 	}
-	return fmt.Errorf("Unable to release address [%s] in namespace [%s]", address, namespace)
+	m.owners[address][owner] = true
 }
 
-// buildHostsFromCidr - Builds a list of addresses in the cidr
-func buildHostsFromCidr(cidr string) ([]string, error) {
-	var ips []string
-
-	// Split the ipranges (comma seperated)
-	cidrs := strings.Split(cidr, ",")
-	if len(cidrs) == 0 {
-		return nil, fmt.Errorf("Unable to parse IP cidrs [%s]", cidr)
+// updatePool - rebuilds the address pool if its definition has changed
+func (m *ipManager) updatePool(kind poolKind, definition string) error {
+	if m.pool != nil && m.kind == kind && m.definition == definition {
+		return nil
 	}
+	pool, err := parsePoolKind(kind, definition)
+	if err != nil {
+		return err
+	}
+	m.setPool(definition, pool)
+	m.kind, m.definition = kind, definition
+	return nil
+}
 
-	for x := range cidrs {
-
-		ip, ipnet, err := net.ParseCIDR(cidrs[x])
-		if err != nil {
-			return nil, err
-		}
-
-		var cidrips []string
-		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-			cidrips = append(cidrips, ip.String())
-		}
+// setPool - replaces the address pool, addresses marked as used are kept
+func (m *ipManager) setPool(definition string, pool *addressPool) {
+	m.pool = pool
+	m.rand = newPoolRand(m.name, definition)
+	klog.Infof("Rebuilding address pool for [%s], [%s] addresses exist", m.name, m.pool.size())
+}
 
-		// remove network address and broadcast address
-		lenIPs := len(cidrips)
-		switch {
-		case lenIPs < 2:
-			ips = append(ips, cidrips...)
+// findAvailableHost - marks and returns an unused host of the requested family, picked by the requested strategy
+func (m *ipManager) findAvailableHost(definition string, req Request) (string, error) {
+	var address string
+	var ok bool
 
+	// find a host that isn't marked (i.e. unused) or quarantined
+	quarantined := m.quarantined(req.Quarantine)
+	used := m.withQuarantine(quarantined)
+	// A recreated service is given back the address it had before
+	address, ok = m.stickyAddress(req.Key, req.Family, req.Retention)
+	if !ok {
+		switch req.Strategy {
+		case HighestFirst:
+			address, ok = m.pool.highestFree(req.Family, used)
+		case Random, Hash:
+			offset := new(big.Int)
+			if size := m.pool.familySize(req.Family); size.Sign() > 0 {
+				if req.Strategy == Random {
+					offset = randomOffset(m.rand, size)
+				} else {
+					offset = hashOffset(req.Key, size)
+				}
+			}
+			address, ok = m.pool.free(req.Family, offset, used)
 		default:
-			ips = append(ips, cidrips[1:len(cidrips)-1]...)
+			address, ok = m.pool.free(req.Family, new(big.Int), used)
 		}
 	}
-	return removeDuplicateAddresses(ips), nil
+	if !ok {
+		// Quarantined addresses are handed out last, the one released longest ago first
+		address, ok = m.oldestQuarantined(req.Family, quarantined)
+	}
+	if ok {
+		// Mark it to used
+		m.mark(address, req.Owner)
+		return address, nil
+	}
+
+	// If we have found the manager for this pool and not returned an address then we've expired the range
+	if req.Family != "" {
+		return "", fmt.Errorf("No %s addresses available in [%s] range [%s]", req.Family, m.name, definition)
+	}
+	return "", fmt.Errorf("No addresses available in [%s] range [%s]", m.name, definition)
 }
 
-// buildHostsFromRange - Builds a list of addresses in the cidr
-func buildHostsFromRange(ipRangeString string) ([]string, error) {
-	var ips []string
+// AddressFamily - returns the family of an address, or an empty Family if it can't be parsed
+func AddressFamily(address string) Family {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return IPv4
+	default:
+		return IPv6
+	}
+}
 
-	// Split the ipranges (comma seperated)
-	ranges := strings.Split(ipRangeString, ",")
-	if len(ranges) == 0 {
-		return nil, fmt.Errorf("Unable to parse IP ranges [%s]", ipRangeString)
+// NormalizeAddress - returns an address in the form that addresses are handed out and held in
+func NormalizeAddress(address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("Unable to parse address [%s]", address)
 	}
+	return ip.String(), nil
+}
 
-	for x := range ranges {
-		ipRange := strings.Split(ranges[x], "-")
-		// Make sure we have x.x.x.x-x.x.x.x
-		if len(ipRange) != 2 {
-			return nil, fmt.Errorf("Unable to parse IP range [%s]", ranges[x])
-		}
-		startRange := net.ParseIP(ipRange[0]).To4()
-		endRange := net.ParseIP(ipRange[1]).To4()
-		//parse the ranges to make sure we don't end in a crazy loop
-		if startRange[0] > endRange[0] {
-			return nil, fmt.Errorf("First octet of start range [%d] is higher then the ending range [%d]", startRange[0], endRange[0])
-		}
-		if startRange[1] > endRange[1] {
-			return nil, fmt.Errorf("Second octet of start range [%d] is higher then the ending range [%d]", startRange[1], endRange[1])
-		}
-		ips = append(ips, startRange.String())
+// ReleaseAddress - removes the owner's mark on an address, the address is freed once it has no owners. An owner can't
+// release an address it doesn't hold. The address is remembered against the key (namespace/name) of the service.
+func (a *Allocator) ReleaseAddress(name, address, owner, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-		// Break the lowerBytes to an array
-		for !startRange.Equal(endRange) {
-			startRange[3]++
-			ips = append(ips, startRange.String())
-		}
-		klog.Infof("Rebuilding addresse cache, [%d] addresses exist", len(ips))
+	address, err := NormalizeAddress(address)
+	if err != nil {
+		return err
+	}
+	m, ok := a.managers[name]
+	if !ok {
+		return fmt.Errorf("Unable to release address [%s] in pool [%s]", address, name)
+	}
+	if !m.owners[address][owner] {
+		return fmt.Errorf("Unable to release address [%s] in pool [%s], it isn't held by [%s]", address, name, owner)
 	}
-	return removeDuplicateAddresses(ips), nil
+	delete(m.owners[address], owner)
+	if len(m.owners[address]) == 0 {
+		delete(m.owners, address)
+		delete(m.addressManager, address)
+		m.released[address] = now()
+		m.remember(key, address)
+	}
+	return nil
 }
 
-func removeDuplicateAddresses(arr []string) []string {
-	addresses := map[string]bool{}
-	uniqueAddresses := []string{} // Keep all keys from the map into a slice.
+// ReserveAddress - marks an address as used by the owner, so that it won't be handed out from the pool
+func (a *Allocator) ReserveAddress(name, address, owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	for i := range arr {
-		addresses[arr[i]] = true
+	address, err := NormalizeAddress(address)
+	if err != nil {
+		return err
 	}
-	for j := range addresses {
-		uniqueAddresses = append(uniqueAddresses, j)
+	// The pool will be built the first time an address is requested from it
+	m := a.manager(name)
+	if m.addressManager[address] {
+		return fmt.Errorf("Address [%s] is already in use in pool [%s]", address, name)
 	}
-	return uniqueAddresses
+	m.mark(address, owner)
+	return nil
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// ShareAddress - adds an owner to an address that is already in use within the pool
+func (a *Allocator) ShareAddress(name, address, owner string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	address, err := NormalizeAddress(address)
+	if err != nil {
+		return err
+	}
+	m, ok := a.managers[name]
+	if !ok || !m.addressManager[address] {
+		return fmt.Errorf("Unable to share address [%s] in pool [%s], it isn't in use", address, name)
 	}
+	m.mark(address, owner)
+	return nil
 }
@@ -1,11 +1,29 @@
 package ipam
 
 import (
+	"math/big"
+	"net"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
-func Test_buildHostsFromRange(t *testing.T) {
+// hosts - expands the ranges of a pool into a list of addresses
+func hosts(p *addressPool) []string {
+	var addresses []string
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.ranges {
+		for i := new(big.Int).Set(r.start); i.Cmp(r.end) <= 0; i.Add(i, one) {
+			addresses = append(addresses, intToIP(i).String())
+		}
+	}
+	return addresses
+}
+
+func Test_parseRanges(t *testing.T) {
 	type args struct {
 		ipRangeString string
 	}
@@ -47,22 +65,137 @@ func Test_buildHostsFromRange(t *testing.T) {
 			want:    []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13"},
 			wantErr: false,
 		},
+		{
+			name: "range spanning an octet boundary",
+			args: args{
+				"10.0.0.254-10.0.1.1",
+			},
+			want:    []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"},
+			wantErr: false,
+		},
+		{
+			name: "range spanning two octet boundaries",
+			args: args{
+				"10.0.255.255-10.1.0.1",
+			},
+			want:    []string{"10.0.255.255", "10.1.0.0", "10.1.0.1"},
+			wantErr: false,
+		},
+		{
+			name: "range ending at the last address",
+			args: args{
+				"255.255.255.254-255.255.255.255",
+			},
+			want:    []string{"255.255.255.254", "255.255.255.255"},
+			wantErr: false,
+		},
+		{
+			name: "ipv6 range spanning a hextet boundary",
+			args: args{
+				"fd00::ffff-fd00::1:1",
+			},
+			want:    []string{"fd00::ffff", "fd00::1:0", "fd00::1:1"},
+			wantErr: false,
+		},
+		{
+			name: "reversed range",
+			args: args{
+				"10.0.1.0-10.0.0.255",
+			},
+			wantErr: true,
+		},
+		{
+			name: "reversed range with a lower last octet",
+			args: args{
+				"10.0.1.10-10.0.0.250",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing end address",
+			args: args{
+				"10.0.0.1-",
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many addresses",
+			args: args{
+				"10.0.0.1-10.0.0.2-10.0.0.3",
+			},
+			wantErr: true,
+		},
+		{
+			name: "single ipv6 address",
+			args: args{
+				"fd00::10-fd00::10",
+			},
+			want:    []string{"fd00::10"},
+			wantErr: false,
+		},
+		{
+			name: "invalid address",
+			args: args{
+				"192.168.0.10-192.168.0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "mixed families",
+			args: args{
+				"192.168.0.10-fd00::10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "reversed ipv6 range",
+			args: args{
+				"fd00::10-fd00::1",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildHostsFromRange(tt.args.ipRangeString)
+			ranges, err := parseRanges(tt.args.ipRangeString)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("buildHostsFromRange() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("parseRanges() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildHostsFromRange() = %v, want %v", got, tt.want)
+			if got := hosts(ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRangesSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipRange string
+		want    int64
+	}{
+		{name: "octet wrap", ipRange: "10.0.0.250-10.0.1.10", want: 17},
+		{name: "lower last octet in the end address", ipRange: "10.0.1.5-10.1.0.1", want: 65277},
+		{name: "lower middle octets in the end address", ipRange: "10.0.255.255-11.0.0.0", want: 16711682},
+		{name: "lower second octet in the end address", ipRange: "10.1.0.0-11.0.0.0", want: 16711681},
+		{name: "ipv6 spanning a /64", ipRange: "fd00::ffff:ffff:ffff:ffff-fd00:0:0:1::", want: 2},
+		{name: "adjacent ranges", ipRange: "10.0.0.1-10.0.0.255,10.0.1.0-10.0.1.10", want: 266},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parseRanges(tt.ipRange)
+			if err != nil {
+				t.Fatalf("parseRanges() error = %v", err)
+			}
+			if got := ranges.size(); got.Cmp(big.NewInt(tt.want)) != 0 {
+				t.Errorf("parseRanges() size = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_buildHostsFromCidr(t *testing.T) {
+func Test_parseCidrs(t *testing.T) {
 	type args struct {
 		cidr string
 	}
@@ -88,17 +221,863 @@ func Test_buildHostsFromCidr(t *testing.T) {
 			want:    []string{"192.168.0.201", "192.168.0.202", "192.168.0.203", "192.168.0.204", "192.168.0.205", "192.168.0.206"},
 			wantErr: false,
 		},
+		{
+			name: "single ipv6 entry, one address",
+			args: args{
+				"fd00::10/128",
+			},
+			want:    []string{"fd00::10"},
+			wantErr: false,
+		},
+		{
+			name: "single ipv6 entry, subnet-router anycast removed",
+			args: args{
+				"fd00::10/127",
+			},
+			want:    []string{"fd00::11"},
+			wantErr: false,
+		},
+		{
+			name: "ipv4-mapped entry, broadcast removed",
+			args: args{
+				"::ffff:192.168.0.200/126",
+			},
+			want:    []string{"192.168.0.201", "192.168.0.202"},
+			wantErr: false,
+		},
+		{
+			name: "invalid entry",
+			args: args{
+				"192.168.0.200/30,fd00::/33/1",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parseCidrs(tt.args.cidr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCidrs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := hosts(ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCidrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostFromCidrFamily(t *testing.T) {
+	a := NewAllocator()
+	cidr := "192.168.0.200/30,fd00::10/127"
+
+	tests := []struct {
+		name    string
+		family  Family
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv6 address", family: IPv6, want: "fd00::11"},
+		{name: "ipv4 address", family: IPv4, want: "192.168.0.201"},
+		{name: "any address", family: "", want: "192.168.0.202"},
+		{name: "ipv6 exhausted", family: IPv6, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.FindAvailableHostFromCidr("default", cidr, Request{Family: tt.family})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindAvailableHostFromCidr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("FindAvailableHostFromCidr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostFromCidrIPv4Mapped(t *testing.T) {
+	a := NewAllocator()
+	cidr := "::ffff:10.0.0.0/126"
+	if got, err := a.FindAvailableHostFromCidr("default", cidr, Request{Family: IPv6}); err == nil {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want no IPv6 address from an IPv4-mapped prefix", got)
+	}
+	for _, want := range []string{"10.0.0.1", "10.0.0.2"} {
+		got, err := a.FindAvailableHostFromCidr("default", cidr, Request{Family: IPv4})
+		if err != nil {
+			t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("FindAvailableHostFromCidr() = %v, want %v", got, want)
+		}
+	}
+	if got, err := a.FindAvailableHostFromCidr("default", cidr, Request{Family: IPv4}); err == nil {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want the broadcast address left out", got)
+	}
+}
+
+func TestFindAvailableHostFromCidrLargePool(t *testing.T) {
+	a := NewAllocator()
+	for _, want := range []string{"fd00::1", "fd00::2", "fd00::3"} {
+		got, err := a.FindAvailableHostFromCidr("default", "fd00::/64", Request{Family: IPv6})
+		if err != nil {
+			t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("FindAvailableHostFromCidr() = %v, want %v", got, want)
+		}
+	}
+	if err := a.ReleaseAddress("default", "fd00::2", "", ""); err != nil {
+		t.Fatalf("ReleaseAddress() error = %v", err)
+	}
+	if got, _ := a.FindAvailableHostFromCidr("default", "fd00::/64", Request{Family: IPv6}); got != "fd00::2" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want released address fd00::2", got)
+	}
+}
+
+// materializedHosts - the previous implementation, which expanded every address of a cidr into a list
+func materializedHosts(cidr string) []string {
+	var ips []string
+	ip, ipnet, _ := net.ParseCIDR(cidr)
+	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+		ips = append(ips, ip.String())
+	}
+	return ips[1 : len(ips)-1]
+}
+
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// benchmarkAllocations - is the number of addresses taken from a fresh /16 pool per iteration
+const benchmarkAllocations = 256
+
+func BenchmarkAllocateMaterialized(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		hosts := materializedHosts("10.0.0.0/16")
+		used := map[string]bool{}
+		for x := 0; x < benchmarkAllocations; x++ {
+			for y := range hosts {
+				if !used[hosts[y]] {
+					used[hosts[y]] = true
+					break
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		pool, _ := parseCidrs("10.0.0.0/16")
+		used := map[string]bool{}
+		for x := 0; x < benchmarkAllocations; x++ {
+			address, _ := pool.free(IPv4, new(big.Int), used)
+			used[address] = true
+		}
+	}
+}
+
+func TestReserveAddress(t *testing.T) {
+	a := NewAllocator()
+	if err := a.ReserveAddress("default", "192.168.0.201", ""); err != nil {
+		t.Fatalf("ReserveAddress() error = %v", err)
+	}
+	if err := a.ReserveAddress("default", "192.168.0.201", ""); err == nil {
+		t.Errorf("ReserveAddress() expected an error reserving an address twice")
+	}
+	got, err := a.FindAvailableHostFromCidr("default", "192.168.0.200/30", Request{Family: IPv4})
+	if err != nil {
+		t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+	}
+	if got != "192.168.0.202" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want 192.168.0.202", got)
+	}
+}
+
+func TestReserveAddressNormalized(t *testing.T) {
+	a := NewAllocator()
+	if err := a.ReserveAddress("default", "fd00:0:0::1", ""); err != nil {
+		t.Fatalf("ReserveAddress() error = %v", err)
+	}
+	if err := a.ReserveAddress("default", "FD00::1", ""); err == nil {
+		t.Errorf("ReserveAddress() expected an error reserving the same address written differently")
+	}
+	if err := a.ReserveAddress("default", "fd00::1::", ""); err == nil {
+		t.Errorf("ReserveAddress() expected an error reserving an invalid address")
+	}
+	got, err := a.FindAvailableHostFromCidr("default", "fd00::/120", Request{Family: IPv6})
+	if err != nil {
+		t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+	}
+	if got != "fd00::2" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want fd00::2", got)
+	}
+}
+
+func TestAllocatorConcurrentAllocation(t *testing.T) {
+	a := NewAllocator()
+	const workers, perWorker = 8, 25
+
+	var wg sync.WaitGroup
+	results := make(chan string, workers*perWorker)
+	errs := make(chan error, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for x := 0; x < perWorker; x++ {
+				address, err := a.FindAvailableHostFromCidr("default", "10.0.0.0/24", Request{Family: IPv4})
+				if err != nil {
+					errs <- err
+					return
+				}
+				results <- address
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+	}
+	seen := map[string]bool{}
+	for address := range results {
+		if seen[address] {
+			t.Fatalf("FindAvailableHostFromCidr() returned [%s] twice", address)
+		}
+		seen[address] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("FindAvailableHostFromCidr() returned %d addresses, want %d", len(seen), workers*perWorker)
+	}
+}
+
+func TestAllocatorConcurrentAllocationAndRelease(t *testing.T) {
+	a := NewAllocator()
+	const workers, rounds = 8, 50
+
+	// Every worker holds at most one address at a time, a /29 (6 hosts) can't satisfy 8 workers so some will fail
+	var mu sync.Mutex
+	held := map[string]int{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for x := 0; x < rounds; x++ {
+				address, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.6", Request{Family: IPv4})
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				if owner, ok := held[address]; ok {
+					mu.Unlock()
+					t.Errorf("address [%s] handed to worker %d while held by worker %d", address, worker, owner)
+					return
+				}
+				held[address] = worker
+				mu.Unlock()
+
+				mu.Lock()
+				delete(held, address)
+				mu.Unlock()
+				if err := a.ReleaseAddress("default", address, "", ""); err != nil {
+					t.Errorf("ReleaseAddress() error = %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestFindAvailableHostStrategies(t *testing.T) {
+	const pool = "10.0.0.1-10.0.0.4,10.0.1.1-10.0.1.4"
+
+	tests := []struct {
+		name     string
+		strategy Strategy
+		keys     []string
+		want     []string
+	}{
+		{
+			name:     "lowest first",
+			strategy: LowestFirst,
+			keys:     []string{"default/a", "default/b", "default/c"},
+			want:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:     "highest first",
+			strategy: HighestFirst,
+			keys:     []string{"default/a", "default/b", "default/c"},
+			want:     []string{"10.0.1.4", "10.0.1.3", "10.0.1.2"},
+		},
+		{
+			name:     "hash, same key moves to the next free address",
+			strategy: Hash,
+			keys:     []string{"default/a", "default/a", "default/a"},
+		},
+		{
+			name:     "random",
+			strategy: Random,
+			keys:     []string{"default/a", "default/b", "default/c", "default/d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two allocators given the same requests must hand out the same addresses
+			first, second := NewAllocator(), NewAllocator()
+			seen := map[string]bool{}
+			for x, key := range tt.keys {
+				req := Request{Strategy: tt.strategy, Key: key}
+				got, err := first.FindAvailableHostFromRange("default", pool, req)
+				if err != nil {
+					t.Fatalf("FindAvailableHostFromRange() error = %v", err)
+				}
+				again, err := second.FindAvailableHostFromRange("default", pool, req)
+				if err != nil {
+					t.Fatalf("FindAvailableHostFromRange() error = %v", err)
+				}
+				if got != again {
+					t.Errorf("FindAvailableHostFromRange() = %v and %v, want the same address", got, again)
+				}
+				if seen[got] {
+					t.Errorf("FindAvailableHostFromRange() returned [%s] twice", got)
+				}
+				seen[got] = true
+				if tt.want != nil && got != tt.want[x] {
+					t.Errorf("FindAvailableHostFromRange() = %v, want %v", got, tt.want[x])
+				}
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostStrategyExhausted(t *testing.T) {
+	for _, strategy := range []Strategy{LowestFirst, HighestFirst, Random, Hash} {
+		a := NewAllocator()
+		seen := map[string]bool{}
+		for x := 0; x < 4; x++ {
+			got, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.2,10.0.1.1-10.0.1.2", Request{Strategy: strategy, Key: "default/a"})
+			if err != nil {
+				t.Fatalf("%s: FindAvailableHostFromRange() error = %v", strategy, err)
+			}
+			if seen[got] {
+				t.Fatalf("%s: FindAvailableHostFromRange() returned [%s] twice", strategy, got)
+			}
+			seen[got] = true
+		}
+		if _, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.2,10.0.1.1-10.0.1.2", Request{Strategy: strategy, Key: "default/a"}); err == nil {
+			t.Errorf("%s: FindAvailableHostFromRange() expected an error from an exhausted pool", strategy)
+		}
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Strategy
+		wantErr bool
+	}{
+		{name: "", want: LowestFirst},
+		{name: "highest", want: HighestFirst},
+		{name: "hash", want: Hash},
+		{name: "roundrobin", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseStrategy(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseStrategy(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_parsePoolExclusions(t *testing.T) {
+	tests := []struct {
+		name             string
+		definition       string
+		cidr             bool
+		want             []string
+		wantReservations map[string]string
+		wantErr          bool
+	}{
+		{
+			name:       "cidr with address and range exclusions",
+			definition: "192.168.0.0/29,!192.168.0.1,!192.168.0.3-192.168.0.4",
+			cidr:       true,
+			want:       []string{"192.168.0.2", "192.168.0.5", "192.168.0.6"},
+		},
+		{
+			name:       "range with a cidr exclusion",
+			definition: "10.0.0.1-10.0.0.10,!10.0.0.4/30",
+			want:       []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.8", "10.0.0.9", "10.0.0.10"},
+		},
+		{
+			name:       "exclusion covering the whole pool",
+			definition: "10.0.0.1-10.0.0.3, !10.0.0.0-10.0.0.5",
+		},
+		{
+			name:       "ipv6 exclusion",
+			definition: "fd00::1-fd00::4,!fd00::2",
+			want:       []string{"fd00::1", "fd00::3", "fd00::4"},
+		},
+		{
+			name:             "named reservation",
+			definition:       "192.168.0.200/30,gateway=192.168.0.201",
+			cidr:             true,
+			want:             []string{"192.168.0.202"},
+			wantReservations: map[string]string{"gateway": "192.168.0.201"},
+		},
+		{
+			name:       "reservation outside of the pool",
+			definition: "192.168.0.200/30,gateway=192.168.0.1",
+			cidr:       true,
+			wantErr:    true,
+		},
+		{
+			name:       "duplicate reservation",
+			definition: "10.0.0.1-10.0.0.10,dns=10.0.0.2,dns=10.0.0.3",
+			wantErr:    true,
+		},
+		{
+			name:       "reservation without a name",
+			definition: "10.0.0.1-10.0.0.10,=10.0.0.2",
+			wantErr:    true,
+		},
+		{
+			name:       "invalid exclusion",
+			definition: "10.0.0.1-10.0.0.10,!10.0.0",
+			wantErr:    true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildHostsFromCidr(tt.args.cidr)
+			var pool *addressPool
+			var err error
+			if tt.cidr {
+				pool, err = parseCidrs(tt.definition)
+			} else {
+				pool, err = parseRanges(tt.definition)
+			}
 			if (err != nil) != tt.wantErr {
-				t.Errorf("buildHostsFromCidr() error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("parsePool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildHostsFromCidr() = %v, want %v", got, tt.want)
+			if got := hosts(pool); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePool() = %v, want %v", got, tt.want)
+			}
+			if tt.wantReservations == nil {
+				tt.wantReservations = map[string]string{}
+			}
+			if !reflect.DeepEqual(pool.reservations, tt.wantReservations) {
+				t.Errorf("parsePool() reservations = %v, want %v", pool.reservations, tt.wantReservations)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostExclusions(t *testing.T) {
+	a := NewAllocator()
+	cidr := "192.168.0.0/29,!192.168.0.1,!192.168.0.3-192.168.0.6,gateway=192.168.0.2"
+	if _, err := a.FindAvailableHostFromCidr("default", cidr, Request{}); err == nil {
+		t.Errorf("FindAvailableHostFromCidr() expected an error, every address is excluded or reserved")
+	}
+
+	got, err := Reservation(cidr, "gateway")
+	if err != nil {
+		t.Fatalf("Reservation() error = %v", err)
+	}
+	if got != "192.168.0.2" {
+		t.Errorf("Reservation() = %v, want 192.168.0.2", got)
+	}
+	if _, err := Reservation(cidr, "dns"); err == nil {
+		t.Errorf("Reservation() expected an error for a reservation that doesn't exist")
+	}
+}
+
+func TestReserveHostFromCidr(t *testing.T) {
+	a := NewAllocator()
+	const cidr = "192.168.0.0/29,!192.168.0.1,gateway=192.168.0.6"
+	if err := a.ReserveAddress("testing", "192.168.0.5", ""); err != nil {
+		t.Fatalf("ReserveAddress() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		owner   string
+		wantErr bool
+	}{
+		{name: "free address", address: "192.168.0.2"},
+		{name: "address already reserved", address: "192.168.0.2", wantErr: true},
+		{name: "free address for an owner", address: "192.168.0.4", owner: "uid-a"},
+		{name: "address already held by the owner", address: "192.168.0.4", owner: "uid-a"},
+		{name: "address held by another owner", address: "192.168.0.4", owner: "uid-b", wantErr: true},
+		{name: "address in use in another namespace", address: "192.168.0.5", wantErr: true},
+		{name: "named reservation", address: "192.168.0.6"},
+		{name: "excluded address", address: "192.168.0.1", wantErr: true},
+		{name: "network address", address: "192.168.0.0", wantErr: true},
+		{name: "address outside of the pool", address: "10.0.0.1", wantErr: true},
+		{name: "invalid address", address: "192.168.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.ReserveHostFromCidr("default", cidr, tt.address, tt.owner); (err != nil) != tt.wantErr {
+				t.Errorf("ReserveHostFromCidr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Reserved addresses must not be handed out
+	got, err := a.FindAvailableHostFromCidr("default", cidr, Request{})
+	if err != nil {
+		t.Fatalf("FindAvailableHostFromCidr() error = %v", err)
+	}
+	if got != "192.168.0.3" {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want 192.168.0.3", got)
+	}
+}
+
+func TestFindAvailableHostFromPool(t *testing.T) {
+	a := NewAllocator()
+	const pool = "10.0.0.0/30,10.0.1.1-10.0.1.2,!10.0.0.2"
+	var got []string
+	for x := 0; x < 3; x++ {
+		address, err := a.FindAvailableHostFromPool("pool-dmz", pool, Request{})
+		if err != nil {
+			t.Fatalf("FindAvailableHostFromPool() error = %v", err)
+		}
+		got = append(got, address)
+	}
+	if want := []string{"10.0.0.1", "10.0.1.1", "10.0.1.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAvailableHostFromPool() = %v, want %v", got, want)
+	}
+	if _, err := a.FindAvailableHostFromPool("pool-dmz", pool, Request{}); err == nil {
+		t.Errorf("FindAvailableHostFromPool() expected an error from an exhausted pool")
+	}
+	if err := a.ReserveHostFromPool("pool-dmz", pool, "10.0.1.1", ""); err == nil {
+		t.Errorf("ReserveHostFromPool() expected an error reserving an address in use")
+	}
+}
+
+func TestPoolHasFamily(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    Pool
+		family  Family
+		want    bool
+		wantErr bool
+	}{
+		{name: "ipv4 cidr", pool: NewCidrPool("cidr-default", "10.0.0.0/24"), family: IPv4, want: true},
+		{name: "ipv4 cidr without ipv6", pool: NewCidrPool("cidr-default", "10.0.0.0/24"), family: IPv6},
+		{name: "any family", pool: NewRangePool("range-default", "fd00::1-fd00::ff"), want: true},
+		{name: "ipv6 range", pool: NewRangePool("range-default", "fd00::1-fd00::ff"), family: IPv6, want: true},
+		{name: "mixed pool", pool: NewMixedPool("pool-dmz", "10.0.0.0/30,fd00::1-fd00::ff"), family: IPv6, want: true},
+		{name: "ipv6 reservation", pool: NewMixedPool("pool-dmz", "10.0.0.0/30,fd00::1-fd00::1,gateway=fd00::1"), family: IPv6, want: true},
+		{name: "excluded", pool: NewMixedPool("pool-dmz", "10.0.0.0/30,fd00::1-fd00::2,!fd00::1-fd00::2"), family: IPv6},
+		{name: "invalid pool", pool: NewCidrPool("cidr-default", "10.0.0.0/33"), family: IPv4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pool.HasFamily(tt.family)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HasFamily() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("HasFamily() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		network bool
+		want    string
+		wantOk  bool
+		wantErr bool
+	}{
+		{
+			name: "separate cidrs",
+			a:    "192.168.0.0/24",
+			b:    "192.168.1.0/24",
+		},
+		{
+			name:   "cidr within a cidr",
+			a:      "192.168.0.0/16",
+			b:      "192.168.10.0/24",
+			want:   "192.168.10.1",
+			wantOk: true,
+		},
+		{
+			name:   "range and cidr",
+			a:      "10.0.0.1-10.0.0.20",
+			b:      "10.0.0.16/28",
+			want:   "10.0.0.17",
+			wantOk: true,
+		},
+		{
+			name: "overlap removed by an exclusion",
+			a:    "10.0.0.1-10.0.0.20",
+			b:    "10.0.0.16/28,!10.0.0.16-10.0.0.20",
+		},
+		{
+			name:   "overlap with a reservation",
+			a:      "10.0.0.0/29,gateway=10.0.0.1",
+			b:      "10.0.0.1-10.0.0.1",
+			want:   "10.0.0.1",
+			wantOk: true,
+		},
+		{
+			name: "different families",
+			a:    "10.0.0.0/24",
+			b:    "fd00::/120",
+		},
+		{
+			name:    "node address within a pool",
+			a:       "192.168.0.200-192.168.0.250",
+			b:       "192.168.0.210",
+			network: true,
+			want:    "192.168.0.210",
+			wantOk:  true,
+		},
+		{
+			name:    "service cidr outside of a pool",
+			a:       "192.168.0.200-192.168.0.250",
+			b:       "10.96.0.0/12",
+			network: true,
+		},
+		{
+			name:    "invalid pool",
+			a:       "192.168.0.200-192.168.0.50",
+			b:       "10.96.0.0/12",
+			network: true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var ok bool
+			var err error
+			if tt.network {
+				got, ok, err = OverlapNetwork(tt.a, tt.b)
+			} else {
+				got, ok, err = Overlap(tt.a, tt.b)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Overlap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Overlap() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
 			}
 		})
 	}
 }
+
+func TestUpdatePools(t *testing.T) {
+	a := NewAllocator()
+	for _, want := range []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"} {
+		if got, err := a.FindAvailableHostFromCidr("cidr-default", "192.168.0.0/29", Request{}); err != nil || got != want {
+			t.Fatalf("FindAvailableHostFromCidr() = %v, %v, want %v", got, err, want)
+		}
+	}
+	if _, err := a.FindAvailableHostFromRange("range-global", "10.0.0.1-10.0.0.5", Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid pool leaves every pool unchanged
+	if _, err := a.UpdatePools([]Pool{NewCidrPool("cidr-default", "192.168.0.0/30"), NewRangePool("range-global", "10.0.0.5-10.0.0.1")}, nil); err == nil {
+		t.Fatal("UpdatePools() expected an error for an invalid range")
+	}
+	if got := a.managers["cidr-default"].definition; got != "192.168.0.0/29" {
+		t.Errorf("UpdatePools() changed pool to [%s] after an error", got)
+	}
+
+	// Shrinking the cidr leaves an address outside of it and removing the range leaves all of its addresses outside
+	outside, err := a.UpdatePools([]Pool{NewCidrPool("cidr-default", "192.168.0.0/30")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"cidr-default": {"192.168.0.3"}, "range-global": {"10.0.0.1"}}
+	if !reflect.DeepEqual(outside, want) {
+		t.Errorf("UpdatePools() = %v, want %v", outside, want)
+	}
+
+	// The address outside of the pool is still in use
+	if got, err := a.FindAvailableHostFromCidr("cidr-default", "192.168.0.0/30", Request{}); err == nil {
+		t.Errorf("FindAvailableHostFromCidr() = %v, expected the shrunk pool to be exhausted", got)
+	}
+	if err := a.ReleaseAddress("cidr-default", "192.168.0.3", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if outside, _ = a.UpdatePools([]Pool{NewCidrPool("cidr-default", "192.168.0.0/30")}, nil); len(outside["cidr-default"]) != 0 {
+		t.Errorf("UpdatePools() = %v, expected no addresses outside of [cidr-default]", outside)
+	}
+}
+
+func TestUpdatePoolsKeep(t *testing.T) {
+	a := NewAllocator()
+	if _, err := a.FindAvailableHostFromCidr("cidr-global", "10.0.0.0/29", Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pool that is kept isn't emptied and its addresses aren't reported as outside of it
+	outside, err := a.UpdatePools(nil, []string{"cidr-global"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outside) != 0 {
+		t.Errorf("UpdatePools() = %v, expected no addresses outside of their pools", outside)
+	}
+	if got := a.managers["cidr-global"].definition; got != "10.0.0.0/29" {
+		t.Errorf("UpdatePools() changed kept pool to [%s]", got)
+	}
+}
+
+func TestReleaseAddressOwner(t *testing.T) {
+	a := NewAllocator()
+	address, err := a.FindAvailableHostFromCidr("default", "192.168.0.0/30", Request{Owner: "uid-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleaseAddress("default", address, "uid-b", ""); err == nil {
+		t.Errorf("ReleaseAddress() expected an error releasing an address held by another owner")
+	}
+	if err := a.ShareAddress("default", address, "uid-b"); err != nil {
+		t.Fatalf("ShareAddress() error = %v", err)
+	}
+	if err := a.ShareAddress("default", "192.168.0.2", "uid-b"); err == nil {
+		t.Errorf("ShareAddress() expected an error sharing an address that isn't in use")
+	}
+
+	// The address is only freed once both owners have released it
+	if err := a.ReleaseAddress("default", address, "uid-a", ""); err != nil {
+		t.Fatalf("ReleaseAddress() error = %v", err)
+	}
+	if got, _ := a.FindAvailableHostFromCidr("default", "192.168.0.0/30", Request{Owner: "uid-c"}); got == address {
+		t.Errorf("FindAvailableHostFromCidr() = %v, the address is still held by uid-b", got)
+	}
+	if err := a.ReleaseAddress("default", address, "uid-b", ""); err != nil {
+		t.Fatalf("ReleaseAddress() error = %v", err)
+	}
+	if got, _ := a.FindAvailableHostFromCidr("default", "192.168.0.0/30", Request{Owner: "uid-c"}); got != address {
+		t.Errorf("FindAvailableHostFromCidr() = %v, want released address %v", got, address)
+	}
+}
+
+func TestReleaseAddressNormalized(t *testing.T) {
+	a := NewAllocator()
+	if err := a.ReserveHostFromCidr("default", "fd00::/120", "FD00::0005", "uid-a"); err != nil {
+		t.Fatalf("ReserveHostFromCidr() error = %v", err)
+	}
+	if err := a.ShareAddress("default", "fd00:0::5", "uid-b"); err != nil {
+		t.Fatalf("ShareAddress() error = %v", err)
+	}
+	for _, owner := range []string{"uid-a", "uid-b"} {
+		if err := a.ReleaseAddress("default", "FD00::0005", owner, ""); err != nil {
+			t.Fatalf("ReleaseAddress() error = %v", err)
+		}
+	}
+	if err := a.ReserveAddress("default", "fd00::5", "uid-c"); err != nil {
+		t.Errorf("ReserveAddress() error = %v, the address should have been released", err)
+	}
+}
+
+func TestFindAvailableHostQuarantine(t *testing.T) {
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	a := NewAllocator()
+	req := Request{Quarantine: time.Minute}
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if got, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.4", req); err != nil || got != want {
+			t.Fatalf("FindAvailableHostFromRange() = %v, %v, want %v", got, err, want)
+		}
+	}
+	if err := a.ReleaseAddress("default", "10.0.0.2", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(10 * time.Second)
+	if err := a.ReleaseAddress("default", "10.0.0.1", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unused address is handed out first, then the quarantined addresses in the order they were released
+	for _, want := range []string{"10.0.0.4", "10.0.0.2", "10.0.0.1"} {
+		if got, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.4", req); err != nil || got != want {
+			t.Fatalf("FindAvailableHostFromRange() = %v, %v, want %v", got, err, want)
+		}
+	}
+
+	// Once the quarantine has passed the address is handed out in order again
+	if err := a.ReleaseAddress("default", "10.0.0.1", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleaseAddress("default", "10.0.0.4", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(2 * time.Minute)
+	if got, err := a.FindAvailableHostFromRange("default", "10.0.0.1-10.0.0.4", req); err != nil || got != "10.0.0.1" {
+		t.Errorf("FindAvailableHostFromRange() = %v, %v, want 10.0.0.1", got, err)
+	}
+}
+
+func TestFindAvailableHostRetention(t *testing.T) {
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	a := NewAllocator()
+	pool := "10.0.0.1-10.0.0.10"
+	web := Request{Key: "default/web", Owner: "uid-1", Retention: time.Hour}
+	for _, owner := range []string{"uid-other", "uid-1"} {
+		req := web
+		req.Owner = owner
+		if _, err := a.FindAvailableHostFromRange("default", pool, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.ReleaseAddress("default", "10.0.0.2", "uid-1", "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleaseAddress("default", "10.0.0.1", "uid-other", "default/other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recreated service is given its previous address, rather than the lowest free address
+	web.Owner = "uid-2"
+	if got, err := a.FindAvailableHostFromRange("default", pool, web); err != nil || got != "10.0.0.2" {
+		t.Errorf("FindAvailableHostFromRange() = %v, %v, want 10.0.0.2", got, err)
+	}
+
+	// Without retention, or once the period has passed, the address isn't kept for the service
+	if err := a.ReleaseAddress("default", "10.0.0.2", "uid-2", "default/web"); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(2 * time.Hour)
+	web.Owner = "uid-3"
+	if got, err := a.FindAvailableHostFromRange("default", pool, web); err != nil || got != "10.0.0.1" {
+		t.Errorf("FindAvailableHostFromRange() = %v, %v, want 10.0.0.1", got, err)
+	}
+}
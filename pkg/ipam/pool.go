@@ -0,0 +1,424 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+var one = big.NewInt(1)
+
+// addressRange - an inclusive range of addresses within a single family, held as integers
+type addressRange struct {
+	family     Family
+	start, end *big.Int
+}
+
+// addressPool - a sorted set of non-overlapping ranges, the addresses within them are never expanded into a list
+type addressPool struct {
+	ranges []addressRange
+	// reservations maps a name to an address that is held back from the ranges
+	reservations map[string]string
+}
+
+// newAddressPool - sorts the ranges and merges any that overlap or are adjacent
+func newAddressPool(ranges []addressRange) *addressPool {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start.Cmp(ranges[j].start) < 0
+	})
+
+	p := &addressPool{}
+	for _, r := range ranges {
+		if last := len(p.ranges) - 1; last >= 0 && p.ranges[last].family == r.family {
+			// Merge if the range starts at or before the address after the end of the previous range
+			if r.start.Cmp(new(big.Int).Add(p.ranges[last].end, one)) <= 0 {
+				if r.end.Cmp(p.ranges[last].end) > 0 {
+					p.ranges[last].end = r.end
+				}
+				continue
+			}
+		}
+		p.ranges = append(p.ranges, addressRange{family: r.family, start: r.start, end: r.end})
+	}
+	return p
+}
+
+// without - returns a pool of the addresses that aren't in any of the excluded ranges
+func (p *addressPool) without(exclude []addressRange) *addressPool {
+	excluded := newAddressPool(exclude).ranges
+
+	result := &addressPool{}
+	for _, r := range p.ranges {
+		start := new(big.Int).Set(r.start)
+		for _, e := range excluded {
+			if e.end.Cmp(start) < 0 || e.start.Cmp(r.end) > 0 {
+				continue
+			}
+			// Keep the addresses before the exclusion
+			if e.start.Cmp(start) > 0 {
+				result.ranges = append(result.ranges, addressRange{family: r.family, start: start, end: new(big.Int).Sub(e.start, one)})
+			}
+			start = new(big.Int).Add(e.end, one)
+		}
+		if start.Cmp(r.end) <= 0 {
+			result.ranges = append(result.ranges, addressRange{family: r.family, start: start, end: r.end})
+		}
+	}
+	return result
+}
+
+// size - returns the number of addresses in the pool
+func (p *addressPool) size() *big.Int {
+	total := new(big.Int)
+	for _, r := range p.ranges {
+		total.Add(total, new(big.Int).Sub(r.end, r.start))
+		total.Add(total, one)
+	}
+	return total
+}
+
+// contains - checks if an address is within the pool
+func (p *addressPool) contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	i := ipToInt(ip)
+	for _, r := range p.ranges {
+		if r.start.Cmp(i) <= 0 && r.end.Cmp(i) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reserved - checks if an address is one of the pool's named reservations
+func (p *addressPool) reserved(address string) bool {
+	for _, reservation := range p.reservations {
+		if reservation == address {
+			return true
+		}
+	}
+	return false
+}
+
+// family - returns the ranges of the family, an empty family returns every range
+func (p *addressPool) family(family Family) []addressRange {
+	if family == "" {
+		return p.ranges
+	}
+	var ranges []addressRange
+	for _, r := range p.ranges {
+		if r.family == family {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// familySize - returns the number of addresses of the family in the pool
+func (p *addressPool) familySize(family Family) *big.Int {
+	return (&addressPool{ranges: p.family(family)}).size()
+}
+
+// free - returns the first address of the family that isn't marked as used, scanning upwards from the address at
+// offset within the pool and wrapping around to the start. Only used addresses are ever skipped.
+func (p *addressPool) free(family Family, offset *big.Int, used map[string]bool) (string, bool) {
+	ranges := p.family(family)
+	if len(ranges) == 0 {
+		return "", false
+	}
+
+	// Find the range holding the offset
+	start, from := 0, new(big.Int).Set(offset)
+	for ; start < len(ranges); start++ {
+		size := new(big.Int).Sub(ranges[start].end, ranges[start].start)
+		size.Add(size, one)
+		if from.Cmp(size) < 0 {
+			break
+		}
+		from.Sub(from, size)
+	}
+	if start == len(ranges) {
+		start, from = 0, new(big.Int)
+	}
+
+	// Scan from the offset to the end of the pool, then from the start of the pool back up to the offset
+	for x := 0; x <= len(ranges); x++ {
+		r := ranges[(start+x)%len(ranges)]
+		first, last := r.start, r.end
+		switch x {
+		case 0:
+			first = new(big.Int).Add(r.start, from)
+		case len(ranges):
+			last = new(big.Int).Add(r.start, from)
+			last.Sub(last, one)
+		}
+		for i := new(big.Int).Set(first); i.Cmp(last) <= 0; i.Add(i, one) {
+			address := intToIP(i).String()
+			if !used[address] {
+				return address, true
+			}
+		}
+	}
+	return "", false
+}
+
+// highestFree - returns the highest address of the family that isn't marked as used
+func (p *addressPool) highestFree(family Family, used map[string]bool) (string, bool) {
+	ranges := p.family(family)
+	for x := len(ranges) - 1; x >= 0; x-- {
+		for i := new(big.Int).Set(ranges[x].end); i.Cmp(ranges[x].start) >= 0; i.Sub(i, one) {
+			address := intToIP(i).String()
+			if !used[address] {
+				return address, true
+			}
+		}
+	}
+	return "", false
+}
+
+// poolKind - decides how the address blocks in a pool definition are parsed
+type poolKind int
+
+const (
+	// cidrPool - address blocks are cidrs
+	cidrPool poolKind = iota
+	// rangePool - address blocks are ranges (x.x.x.x-x.x.x.x)
+	rangePool
+	// mixedPool - address blocks are either cidrs or ranges
+	mixedPool
+)
+
+// parsePoolKind - parses a pool definition of the kind
+func parsePoolKind(kind poolKind, definition string) (*addressPool, error) {
+	switch kind {
+	case cidrPool:
+		return parseCidrs(definition)
+	case rangePool:
+		return parseRanges(definition)
+	default:
+		return parsePool(definition, func(entry string) ([]addressRange, error) {
+			if strings.Contains(entry, "/") {
+				return parseCidrEntry(entry)
+			}
+			return parseRangeEntry(entry)
+		})
+	}
+}
+
+// parseCidrs - parses a comma seperated list of cidrs, exclusions and reservations into a pool of usable host addresses
+func parseCidrs(cidr string) (*addressPool, error) {
+	return parsePool(cidr, parseCidrEntry)
+}
+
+// parseRanges - parses a comma seperated list of ranges (x.x.x.x-x.x.x.x), exclusions and reservations into a pool
+func parseRanges(ipRangeString string) (*addressPool, error) {
+	return parsePool(ipRangeString, parseRangeEntry)
+}
+
+// parsePool - parses each entry of a pool definition, an entry is one of:
+//   - an address block, parsed by parseEntry
+//   - an exclusion (!x.x.x.x, !x.x.x.x-x.x.x.x or !x.x.x.x/x) that is never handed out
+//   - a named reservation (name=x.x.x.x) that is only handed out when it is asked for
+func parsePool(definition string, parseEntry func(entry string) ([]addressRange, error)) (*addressPool, error) {
+	var include, exclude []addressRange
+	reservations := map[string]string{}
+
+	// Split the entries (comma seperated)
+	entries := strings.Split(definition, ",")
+	for x := range entries {
+		entry := strings.TrimSpace(entries[x])
+		switch {
+		case strings.HasPrefix(entry, "!"):
+			r, err := parseExclusion(entry)
+			if err != nil {
+				return nil, err
+			}
+			exclude = append(exclude, r)
+		case strings.Contains(entry, "="):
+			name, address, err := parseReservation(entry)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := reservations[name]; ok {
+				return nil, fmt.Errorf("Reservation [%s] is defined more than once", name)
+			}
+			reservations[name] = address
+		default:
+			ranges, err := parseEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+			include = append(include, ranges...)
+		}
+	}
+
+	p := newAddressPool(include)
+	for name, address := range reservations {
+		if !p.contains(address) {
+			return nil, fmt.Errorf("Reservation [%s] address [%s] is outside of the pool", name, address)
+		}
+		i := ipToInt(net.ParseIP(address))
+		exclude = append(exclude, addressRange{family: AddressFamily(address), start: i, end: i})
+	}
+	p = p.without(exclude)
+	p.reservations = reservations
+	return p, nil
+}
+
+// parseCidrEntry - parses a cidr into the range of its usable host addresses
+func parseCidrEntry(entry string) ([]addressRange, error) {
+	r, err := parseCidr(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r.start.Cmp(r.end) == 0:
+	case r.family == IPv6:
+		// IPv6 has no broadcast address, only remove the subnet-router anycast address
+		r.start.Add(r.start, one)
+	default:
+		// remove network address and broadcast address
+		r.start.Add(r.start, one)
+		r.end.Sub(r.end, one)
+	}
+	if r.start.Cmp(r.end) > 0 {
+		return nil, nil
+	}
+	return []addressRange{r}, nil
+}
+
+// parseCidr - parses a cidr into the range of every address within it
+func parseCidr(entry string) (addressRange, error) {
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return addressRange{}, fmt.Errorf("Unable to parse IP cidr [%s]: %v", entry, err)
+	}
+
+	ones, size := ipnet.Mask.Size()
+	start := ipToInt(ipnet.IP)
+	end := new(big.Int).Add(start, new(big.Int).Lsh(one, uint(size-ones)))
+	end.Sub(end, one)
+
+	// An IPv4-mapped IPv6 prefix (::ffff:x.x.x.x/x) holds IPv4 addresses, which are handed out in their IPv4 form
+	family := IPv6
+	if ipnet.IP.To4() != nil {
+		family = IPv4
+	}
+	return addressRange{family: family, start: start, end: end}, nil
+}
+
+// parseRangeEntry - parses a range (x.x.x.x-x.x.x.x)
+func parseRangeEntry(entry string) ([]addressRange, error) {
+	ipRange := strings.Split(entry, "-")
+	// Make sure we have x.x.x.x-x.x.x.x
+	if len(ipRange) != 2 {
+		return nil, fmt.Errorf("Unable to parse IP range [%s]", entry)
+	}
+	startRange, endRange, err := parseRange(entry, ipRange[0], ipRange[1])
+	if err != nil {
+		return nil, err
+	}
+	family := IPv6
+	if len(startRange) == net.IPv4len {
+		family = IPv4
+	}
+	return []addressRange{{family: family, start: ipToInt(startRange), end: ipToInt(endRange)}}, nil
+}
+
+// parseExclusion - parses an exclusion, which is a single address, a range or a cidr (all of its addresses)
+func parseExclusion(entry string) (addressRange, error) {
+	exclusion := strings.TrimSpace(strings.TrimPrefix(entry, "!"))
+	switch {
+	case strings.Contains(exclusion, "/"):
+		return parseCidr(exclusion)
+	case strings.Contains(exclusion, "-"):
+		ranges, err := parseRangeEntry(exclusion)
+		if err != nil {
+			return addressRange{}, err
+		}
+		return ranges[0], nil
+	default:
+		ip := net.ParseIP(exclusion)
+		if ip == nil {
+			return addressRange{}, fmt.Errorf("Unable to parse excluded address [%s]", entry)
+		}
+		i := ipToInt(ip)
+		return addressRange{family: AddressFamily(exclusion), start: i, end: new(big.Int).Set(i)}, nil
+	}
+}
+
+// parseReservation - parses a named reservation (name=x.x.x.x)
+func parseReservation(entry string) (string, string, error) {
+	parts := strings.SplitN(entry, "=", 2)
+	name, address := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if name == "" {
+		return "", "", fmt.Errorf("Reservation [%s] has no name", entry)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", "", fmt.Errorf("Unable to parse address [%s] of reservation [%s]", address, name)
+	}
+	return name, ip.String(), nil
+}
+
+// parseRange - parses the start and end of a range, ensuring they are of the same family and in order
+func parseRange(entry, start, end string) (net.IP, net.IP, error) {
+	startRange := net.ParseIP(strings.TrimSpace(start))
+	if startRange == nil {
+		return nil, nil, fmt.Errorf("Unable to parse start address [%s] of IP range [%s]", start, entry)
+	}
+	endRange := net.ParseIP(strings.TrimSpace(end))
+	if endRange == nil {
+		return nil, nil, fmt.Errorf("Unable to parse end address [%s] of IP range [%s]", end, entry)
+	}
+	if (startRange.To4() == nil) != (endRange.To4() == nil) {
+		return nil, nil, fmt.Errorf("Start and end address of IP range [%s] are of different families", entry)
+	}
+	// Keep IPv4 addresses in their 4 byte form
+	if startRange.To4() != nil {
+		startRange, endRange = startRange.To4(), endRange.To4()
+	}
+	//parse the ranges to make sure we don't end in a crazy loop
+	if bytes.Compare(startRange, endRange) > 0 {
+		return nil, nil, fmt.Errorf("Start address [%s] of IP range [%s] is higher then the end address [%s]", startRange, entry, endRange)
+	}
+	return startRange, endRange, nil
+}
+
+// ipToInt - converts an address to an integer, IPv4 addresses are held in their IPv4-mapped IPv6 form
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// intToIP - converts an integer back to an address
+func intToIP(i *big.Int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[net.IPv6len-len(b):], b)
+	return ip
+}
+
+// Reservation - returns the address of a named reservation within a pool definition
+func Reservation(definition, name string) (string, error) {
+	entries := strings.Split(definition, ",")
+	for x := range entries {
+		entry := strings.TrimSpace(entries[x])
+		if strings.HasPrefix(entry, "!") || !strings.Contains(entry, "=") {
+			continue
+		}
+		reservation, address, err := parseReservation(entry)
+		if err != nil {
+			return "", err
+		}
+		if reservation == name {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("No reservation named [%s] exists in [%s]", name, definition)
+}
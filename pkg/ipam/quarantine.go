@@ -0,0 +1,52 @@
+package ipam
+
+import (
+	"sort"
+	"time"
+)
+
+// now - returns the current time, it is replaced by tests
+var now = time.Now
+
+// quarantined - returns the addresses released within the quarantine period, oldest release first. Releases older
+// than the period are forgotten.
+func (m *ipManager) quarantined(quarantine time.Duration) []string {
+	var addresses []string
+	cutoff := now().Add(-quarantine)
+	for address, released := range m.released {
+		if quarantine <= 0 || released.Before(cutoff) {
+			delete(m.released, address)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return m.released[addresses[i]].Before(m.released[addresses[j]])
+	})
+	return addresses
+}
+
+// withQuarantine - returns the used addresses along with the quarantined addresses, so that they are skipped
+func (m *ipManager) withQuarantine(quarantined []string) map[string]bool {
+	if len(quarantined) == 0 {
+		return m.addressManager
+	}
+	used := make(map[string]bool, len(m.addressManager)+len(quarantined))
+	for address := range m.addressManager {
+		used[address] = true
+	}
+	for _, address := range quarantined {
+		used[address] = true
+	}
+	return used
+}
+
+// oldestQuarantined - returns the quarantined address of the family (within the pool) that was released first
+func (m *ipManager) oldestQuarantined(family Family, quarantined []string) (string, bool) {
+	for _, address := range quarantined {
+		if (family == "" || AddressFamily(address) == family) && m.pool.contains(address) && !m.addressManager[address] {
+			return address, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Pool - a named pool definition, created with NewCidrPool, NewRangePool or NewMixedPool
+type Pool struct {
+	name       string
+	kind       poolKind
+	definition string
+}
+
+// NewCidrPool - returns a pool of cidrs
+func NewCidrPool(name, cidr string) Pool {
+	return Pool{name: name, kind: cidrPool, definition: cidr}
+}
+
+// NewRangePool - returns a pool of ranges (x.x.x.x-x.x.x.x)
+func NewRangePool(name, ipRange string) Pool {
+	return Pool{name: name, kind: rangePool, definition: ipRange}
+}
+
+// NewMixedPool - returns a pool of cidrs and ranges
+func NewMixedPool(name, definition string) Pool {
+	return Pool{name: name, kind: mixedPool, definition: definition}
+}
+
+// UpdatePools - replaces the definitions of every pool at once, if any of them can't be parsed nothing is changed.
+// Pools named in keep (such as those whose new definition is invalid) are left as they are. Addresses in use are kept,
+// those that are no longer within their pool (including pools that have been removed) are returned by pool name.
+func (a *Allocator) UpdatePools(pools []Pool, keep []string) (map[string][]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	parsed := map[string]*addressPool{}
+	for _, p := range pools {
+		pool, err := parsePoolKind(p.kind, p.definition)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to update pool [%s]: %v", p.name, err)
+		}
+		parsed[p.name] = pool
+	}
+
+	for _, p := range pools {
+		m := a.manager(p.name)
+		if m.pool == nil || m.kind != p.kind || m.definition != p.definition {
+			m.setPool(p.definition, parsed[p.name])
+			m.kind, m.definition = p.kind, p.definition
+		}
+	}
+	kept := map[string]bool{}
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for name, m := range a.managers {
+		// Managers without a pool have only had addresses reserved, their pool isn't known
+		if _, ok := parsed[name]; !ok && !kept[name] && m.pool != nil && m.definition != "" {
+			m.setPool("", &addressPool{})
+			m.definition = ""
+		}
+	}
+
+	outside := map[string][]string{}
+	for name, m := range a.managers {
+		if m.pool == nil || kept[name] {
+			continue
+		}
+		for address := range m.addressManager {
+			if !m.pool.contains(address) && !m.pool.reserved(address) {
+				outside[name] = append(outside[name], address)
+			}
+		}
+		sort.Strings(outside[name])
+	}
+	return outside, nil
+}
@@ -0,0 +1,45 @@
+package ipam
+
+import "time"
+
+// remember - records the address last released by the service with the key
+func (m *ipManager) remember(key, address string) {
+	if key == "" {
+		return
+	}
+	if m.sticky[key] == nil {
+		m.sticky[key] = map[string]time.Time{}
+	}
+	m.sticky[key][address] = now()
+}
+
+// stickyAddress - returns a free address of the family that was released by the service with the key within the
+// retention period, the most recently released first. Addresses released before the period are forgotten.
+func (m *ipManager) stickyAddress(key string, family Family, retention time.Duration) (string, bool) {
+	cutoff := now().Add(-retention)
+	for k, addresses := range m.sticky {
+		for address, released := range addresses {
+			if retention <= 0 || released.Before(cutoff) {
+				delete(addresses, address)
+			}
+		}
+		if len(addresses) == 0 {
+			delete(m.sticky, k)
+		}
+	}
+
+	var address string
+	var latest time.Time
+	for a, released := range m.sticky[key] {
+		if family != "" && AddressFamily(a) != family {
+			continue
+		}
+		if m.addressManager[a] || !m.pool.contains(a) {
+			continue
+		}
+		if address == "" || released.After(latest) {
+			address, latest = a, released
+		}
+	}
+	return address, address != ""
+}
@@ -0,0 +1,53 @@
+package ipam
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"math/rand"
+)
+
+// Strategy - decides which free address of a pool is handed out
+type Strategy string
+
+const (
+	// LowestFirst - hands out the lowest free address (default)
+	LowestFirst Strategy = "lowest"
+	// HighestFirst - hands out the highest free address
+	HighestFirst Strategy = "highest"
+	// Random - hands out a random free address, the sequence is seeded from the pool so is reproducible
+	Random Strategy = "random"
+	// Hash - hands out the first free address at or after the hash of the service's namespace/name
+	Hash Strategy = "hash"
+)
+
+// ParseStrategy - returns the strategy with the name, an empty name is the default LowestFirst strategy
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return LowestFirst, nil
+	case LowestFirst, HighestFirst, Random, Hash:
+		return s, nil
+	default:
+		return "", fmt.Errorf("Unknown allocation strategy [%s], expected one of %s, %s, %s or %s", name, LowestFirst, HighestFirst, Random, Hash)
+	}
+}
+
+// newPoolRand - returns a random source seeded from the pool, so that a pool always hands out the same sequence
+func newPoolRand(name, definition string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name + "/" + definition))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// hashOffset - returns the hash of a key as an offset within a pool of size addresses
+func hashOffset(key string, size *big.Int) *big.Int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), size)
+}
+
+// randomOffset - returns a random offset within a pool of size addresses
+func randomOffset(r *rand.Rand, size *big.Int) *big.Int {
+	return new(big.Int).Rand(r, size)
+}
@@ -0,0 +1,94 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+)
+
+// ValidateCidr - checks that a pool definition of cidrs can be parsed
+func ValidateCidr(cidr string) error {
+	_, err := parseCidrs(cidr)
+	return err
+}
+
+// ValidateRange - checks that a pool definition of ranges can be parsed
+func ValidateRange(ipRange string) error {
+	_, err := parseRanges(ipRange)
+	return err
+}
+
+// ValidatePool - checks that a pool definition of cidrs and ranges can be parsed
+func ValidatePool(definition string) error {
+	_, err := parsePoolKind(mixedPool, definition)
+	return err
+}
+
+// HasFamily - checks if the pool holds any addresses of the family (including its reservations), an empty family
+// matches an address of either family
+func (p Pool) HasFamily(family Family) (bool, error) {
+	pool, err := parsePoolKind(p.kind, p.definition)
+	if err != nil {
+		return false, err
+	}
+	return pool.withReservations().familySize(family).Sign() > 0, nil
+}
+
+// Overlap - returns the lowest address that can be handed out by both pool definitions (cidrs, ranges or a mix of
+// both), reservations are included as they are handed out when they are asked for
+func Overlap(a, b string) (string, bool, error) {
+	poolA, err := parsePoolKind(mixedPool, a)
+	if err != nil {
+		return "", false, err
+	}
+	poolB, err := parsePoolKind(mixedPool, b)
+	if err != nil {
+		return "", false, err
+	}
+	return firstCommon(poolA.withReservations().ranges, poolB.withReservations().ranges)
+}
+
+// OverlapNetwork - returns the lowest address that can be handed out by the pool definition and is within the network,
+// which is an address, a range (x.x.x.x-x.x.x.x) or a cidr (every address within it)
+func OverlapNetwork(definition, network string) (string, bool, error) {
+	pool, err := parsePoolKind(mixedPool, definition)
+	if err != nil {
+		return "", false, err
+	}
+	r, err := parseExclusion(network)
+	if err != nil {
+		return "", false, err
+	}
+	return firstCommon(pool.withReservations().ranges, []addressRange{r})
+}
+
+// withReservations - returns a pool of the addresses in the pool and its reservations
+func (p *addressPool) withReservations() *addressPool {
+	ranges := append([]addressRange{}, p.ranges...)
+	for _, address := range p.reservations {
+		i := ipToInt(net.ParseIP(address))
+		ranges = append(ranges, addressRange{family: AddressFamily(address), start: i, end: new(big.Int).Set(i)})
+	}
+	return newAddressPool(ranges)
+}
+
+// firstCommon - returns the lowest address within both of the sorted sets of ranges
+func firstCommon(a, b []addressRange) (string, bool, error) {
+	for x, y := 0, 0; x < len(a) && y < len(b); {
+		start, end := a[x].start, a[x].end
+		if b[y].start.Cmp(start) > 0 {
+			start = b[y].start
+		}
+		if b[y].end.Cmp(end) < 0 {
+			end = b[y].end
+		}
+		if start.Cmp(end) <= 0 {
+			return intToIP(start).String(), true, nil
+		}
+		if a[x].end.Cmp(b[y].end) < 0 {
+			x++
+		} else {
+			y++
+		}
+	}
+	return "", false, nil
+}
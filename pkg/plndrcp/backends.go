@@ -0,0 +1,263 @@
+package plndrcp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1alpha1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// PodBackendsAnnotation - set to "true" to publish the ready pods of a service as backends, so that traffic can be sent to
+// them directly rather than through the node ports
+const PodBackendsAnnotation = "plndr.io/pod-backends"
+
+// podBackendsEnabled - checks if a service has asked for its pods to be published as backends
+func podBackendsEnabled(service *v1.Service) bool {
+	return service.Annotations[PodBackendsAnnotation] == "true"
+}
+
+// setBackends - updates the node (and pod) backends of a service's record, returning if they changed
+func (plb *plndrLoadBalancerManager) setBackends(record *services, service *v1.Service, nodes []*v1.Node) bool {
+	backends := plb.serviceBackends(service, nodes)
+	var pods []podBackend
+	if podBackendsEnabled(service) {
+		pods = plb.podBackends(service)
+	}
+	changed := !reflect.DeepEqual(backends, record.Backends) || !reflect.DeepEqual(pods, record.PodBackends)
+	record.Backends, record.PodBackends = backends, pods
+	return changed
+}
+
+// podBackends - returns the ready pods (sorted by address) of a service from its EndpointSlices
+func (plb *plndrLoadBalancerManager) podBackends(service *v1.Service) []podBackend {
+	if plb.endpointSliceLister == nil {
+		klog.Warningf("EndpointSlices aren't available, pod backends can't be published for service [%s/%s]", service.Namespace, service.Name)
+		return nil
+	}
+	slices, err := plb.endpointSlices(service)
+	if err != nil {
+		klog.Errorf("Unable to find the endpoints of service [%s/%s]: %v", service.Namespace, service.Name, err)
+		return nil
+	}
+
+	var pods []podBackend
+	for _, slice := range slices {
+		ports := slicePorts(slice)
+		for _, endpoint := range slice.Endpoints {
+			if !endpointReady(endpoint) {
+				continue
+			}
+			var pod string
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				pod = endpoint.TargetRef.Name
+			}
+			for _, address := range endpoint.Addresses {
+				pods = append(pods, podBackend{Address: address, Pod: pod, Ports: ports})
+			}
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Address < pods[j].Address
+	})
+	return pods
+}
+
+// slicePorts - returns the ports served by the endpoints of an EndpointSlice
+func slicePorts(slice *discovery.EndpointSlice) []podPort {
+	var ports []podPort
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		p := podPort{Port: int(*port.Port), Protocol: string(v1.ProtocolTCP)}
+		if port.Name != nil {
+			p.Name = *port.Name
+		}
+		if port.Protocol != nil {
+			p.Protocol = string(*port.Protocol)
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// serviceBackends - returns the backends of a service, with the Local external traffic policy only the nodes that
+// have ready endpoints of the service are backends
+func (plb *plndrLoadBalancerManager) serviceBackends(service *v1.Service, nodes []*v1.Node) []backend {
+	if service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		return nodeBackends(nodes)
+	}
+	if plb.endpointSliceLister == nil {
+		klog.Warningf("EndpointSlices aren't available, every node is a backend of service [%s/%s]", service.Namespace, service.Name)
+		return nodeBackends(nodes)
+	}
+
+	hosts, err := plb.endpointHosts(service)
+	if err != nil {
+		klog.Errorf("Unable to find the endpoints of service [%s/%s], every node is a backend: %v", service.Namespace, service.Name, err)
+		return nodeBackends(nodes)
+	}
+	var local []*v1.Node
+	for _, node := range nodes {
+		if hosts[node.Name] || hosts[node.Labels[v1.LabelHostname]] {
+			local = append(local, node)
+		}
+	}
+	return nodeBackends(local)
+}
+
+// endpointHosts - returns the hosts (from the kubernetes.io/hostname topology) of the service's ready endpoints
+func (plb *plndrLoadBalancerManager) endpointHosts(service *v1.Service) (map[string]bool, error) {
+	slices, err := plb.endpointSlices(service)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpointReady(endpoint) && endpoint.Topology[v1.LabelHostname] != "" {
+				hosts[endpoint.Topology[v1.LabelHostname]] = true
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// endpointSlices - returns the EndpointSlices of a service from the cache
+func (plb *plndrLoadBalancerManager) endpointSlices(service *v1.Service) ([]*discovery.EndpointSlice, error) {
+	selector := labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: service.Name})
+	return plb.endpointSliceLister.EndpointSlices(service.Namespace).List(selector)
+}
+
+// endpointReady - an endpoint without a ready condition is treated as ready
+func endpointReady(endpoint discovery.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// setNodes - keeps the nodes passed by the service controller
+func (plb *plndrLoadBalancerManager) setNodes(nodes []*v1.Node) {
+	plb.nodesMu.Lock()
+	defer plb.nodesMu.Unlock()
+	plb.nodes = nodes
+}
+
+// lastNodes - returns the nodes last passed by the service controller
+func (plb *plndrLoadBalancerManager) lastNodes() []*v1.Node {
+	plb.nodesMu.Lock()
+	defer plb.nodesMu.Unlock()
+	return plb.nodes
+}
+
+// endpointSliceHandler - refreshes the backends of a service whenever its EndpointSlices change
+func (plb *plndrLoadBalancerManager) endpointSliceHandler() cache.ResourceEventHandlerFuncs {
+	changed := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok || slice.Labels[discovery.LabelServiceName] == "" {
+			return
+		}
+		plb.endpointsChanged(slice.Namespace, slice.Labels[discovery.LabelServiceName])
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: changed,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			changed(newObj)
+		},
+		DeleteFunc: changed,
+	}
+}
+
+// endpointsChanged - updates the recorded backends of a load balancer service whose endpoints have changed, only the
+// backends of services with the Local traffic policy or pod backends depend on their endpoints
+func (plb *plndrLoadBalancerManager) endpointsChanged(namespace, name string) {
+	service, err := plb.serviceLister.Services(namespace).Get(name)
+	if err != nil || service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return
+	}
+	if service.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal && !podBackendsEnabled(service) {
+		return
+	}
+	// Until the service controller has passed the nodes, the backends aren't known
+	nodes := plb.lastNodes()
+	if nodes == nil {
+		return
+	}
+
+	// The record is read and written without a sync or removal of the namespace's services in between
+	defer plb.lockNamespace(namespace)()
+
+	cm, err := plb.GetConfigMap(PlunderClientConfig, namespace)
+	if err != nil {
+		return
+	}
+	svc, err := plb.GetServices(cm)
+	if err != nil {
+		return
+	}
+	existing := svc.findService(string(service.UID))
+	if existing == nil {
+		return
+	}
+	if !plb.setBackends(existing, service, nodes) {
+		return
+	}
+	err = plb.modifyServices(namespace, func(svc *plndrServices) error {
+		record := svc.findService(existing.UID)
+		if record == nil {
+			return fmt.Errorf("The record has been removed")
+		}
+		record.Backends, record.PodBackends = existing.Backends, existing.PodBackends
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("Unable to update the backends of service [%s/%s]: %v", namespace, name, err)
+		return
+	}
+	klog.Infof("Updated service [%s/%s] with [%d] backends and [%d] pod backends", namespace, name, len(existing.Backends), len(existing.PodBackends))
+}
+
+// nodeBackends - returns the ready nodes (sorted by name) with the address that traffic should be sent to
+func nodeBackends(nodes []*v1.Node) []backend {
+	var backends []backend
+	for _, node := range nodes {
+		if !nodeReady(node) {
+			continue
+		}
+		if address := nodeAddress(node); address != "" {
+			backends = append(backends, backend{Node: node.Name, Address: address})
+		}
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Node < backends[j].Node
+	})
+	return backends
+}
+
+// nodeReady - checks the node's Ready condition
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeAddress - returns the node's internal address, or its external address if it has no internal address
+func nodeAddress(node *v1.Node) string {
+	for _, addressType := range []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP} {
+		for _, address := range node.Status.Addresses {
+			if address.Type == addressType {
+				return address.Address
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,304 @@
+package plndrcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1alpha1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testNode - returns a node with the Ready condition and addresses
+func testNode(name string, ready bool, addresses ...v1.NodeAddress) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{v1.LabelHostname: name}},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+			Addresses:  addresses,
+		},
+	}
+}
+
+func Test_nodeBackends(t *testing.T) {
+	noCondition := testNode("node-d", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.4"})
+	noCondition.Status.Conditions = nil
+
+	nodes := []*v1.Node{
+		testNode("node-c", true, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.3"}, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.3"}),
+		testNode("node-b", false, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"}),
+		testNode("node-a", true, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"}),
+		testNode("node-e", true, v1.NodeAddress{Type: v1.NodeHostName, Address: "node-e"}),
+		noCondition,
+	}
+	// Not ready nodes, those without a Ready condition and those without an address aren't backends
+	want := []backend{
+		{Node: "node-a", Address: "203.0.113.1"},
+		{Node: "node-c", Address: "192.168.0.3"},
+	}
+	if got := nodeBackends(nodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeBackends() = %v, want %v", got, want)
+	}
+}
+
+func TestSyncLoadBalancerBackends(t *testing.T) {
+	service := loadBalancerService("a")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	nodes := []*v1.Node{
+		testNode("node-a", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"}),
+		testNode("node-b", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"}),
+	}
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nodes); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	// A node that is no longer ready is removed from the backends on the next sync
+	nodes[1] = testNode("node-b", false, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"})
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nodes); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	want := []backend{{Node: "node-a", Address: "192.168.0.1"}}
+	if got := recordedServices(t, client, "default")["uid-a"].Backends; !reflect.DeepEqual(got, want) {
+		t.Errorf("syncLoadBalancer() recorded backends = %v, want %v", got, want)
+	}
+}
+
+// endpointSlices - returns a lister holding the EndpointSlices
+func endpointSlices(slices ...*discovery.EndpointSlice) discoverylisters.EndpointSliceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, slice := range slices {
+		indexer.Add(slice)
+	}
+	return discoverylisters.NewEndpointSliceLister(indexer)
+}
+
+// endpointSlice - returns an EndpointSlice of a service in the default namespace
+func endpointSlice(name, service string, ports []discovery.EndpointPort, endpoints ...discovery.Endpoint) *discovery.EndpointSlice {
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: service},
+		},
+		Ports:     ports,
+		Endpoints: endpoints,
+	}
+}
+
+// testEndpoint - returns an endpoint of a pod on a host, ready is left unset when nil
+func testEndpoint(pod, host string, ready *bool, addresses ...string) discovery.Endpoint {
+	return discovery.Endpoint{
+		Addresses:  addresses,
+		Conditions: discovery.EndpointConditions{Ready: ready},
+		Topology:   map[string]string{v1.LabelHostname: host},
+		TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: pod},
+	}
+}
+
+func Test_serviceBackends(t *testing.T) {
+	ready, notReady := true, false
+	nodes := []*v1.Node{
+		testNode("node-a", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"}),
+		testNode("node-b", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"}),
+		testNode("node-c", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.3"}),
+		testNode("node-d", false, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.4"}),
+	}
+	slice := endpointSlice("web-abcde", "web", nil,
+		testEndpoint("web-1", "node-a", &ready, "10.244.0.1"),
+		testEndpoint("web-2", "node-b", &notReady, "10.244.1.1"),
+		testEndpoint("web-3", "node-d", nil, "10.244.3.1"),
+	)
+	all := []backend{{Node: "node-a", Address: "192.168.0.1"}, {Node: "node-b", Address: "192.168.0.2"}, {Node: "node-c", Address: "192.168.0.3"}}
+
+	tests := []struct {
+		name   string
+		policy v1.ServiceExternalTrafficPolicyType
+		slices bool
+		want   []backend
+	}{
+		{name: "cluster policy", policy: v1.ServiceExternalTrafficPolicyTypeCluster, slices: true, want: all},
+		// node-b's endpoint isn't ready and node-d isn't ready itself
+		{name: "local policy", policy: v1.ServiceExternalTrafficPolicyTypeLocal, slices: true, want: []backend{{Node: "node-a", Address: "192.168.0.1"}}},
+		{name: "local policy without EndpointSlices", policy: v1.ServiceExternalTrafficPolicyTypeLocal, want: all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plb := &plndrLoadBalancerManager{}
+			if tt.slices {
+				plb.endpointSliceLister = endpointSlices(slice)
+			}
+			service := loadBalancerService("web")
+			service.Spec.ExternalTrafficPolicy = tt.policy
+			if got := plb.serviceBackends(service, nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serviceBackends() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncLoadBalancerLocalTrafficPolicy(t *testing.T) {
+	ready := true
+	service := loadBalancerService("web")
+	service.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	service.Spec.HealthCheckNodePort = 32000
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	plb.endpointSliceLister = endpointSlices(endpointSlice("web-abcde", "web", nil, testEndpoint("web-1", "node-b", &ready, "10.244.1.1")))
+	nodes := []*v1.Node{
+		testNode("node-a", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"}),
+		testNode("node-b", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"}),
+	}
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nodes); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	record := recordedServices(t, client, "default")["uid-web"]
+	if record.ExternalTrafficPolicy != "Local" || record.HealthCheckNodePort != 32000 {
+		t.Errorf("syncLoadBalancer() recorded policy = %s (%d), want Local (32000)", record.ExternalTrafficPolicy, record.HealthCheckNodePort)
+	}
+	if want := []backend{{Node: "node-b", Address: "192.168.0.2"}}; !reflect.DeepEqual(record.Backends, want) {
+		t.Errorf("syncLoadBalancer() recorded backends = %v, want %v", record.Backends, want)
+	}
+}
+
+func Test_podBackends(t *testing.T) {
+	ready, notReady := true, false
+	http, metrics, unset, udp := "http", "metrics", "unset", v1.ProtocolUDP
+	port8080, port9090, port53 := int32(8080), int32(9090), int32(53)
+	plb := &plndrLoadBalancerManager{endpointSliceLister: endpointSlices(
+		endpointSlice("web-abcde", "web", []discovery.EndpointPort{{Name: &http, Port: &port8080}, {Name: &metrics, Port: &port9090}, {Name: &unset}},
+			testEndpoint("web-2", "node-b", &ready, "10.244.1.1"),
+			testEndpoint("web-1", "node-a", nil, "10.244.0.1"),
+			testEndpoint("web-3", "node-c", &notReady, "10.244.2.1"),
+		),
+		endpointSlice("web-fghij", "web", []discovery.EndpointPort{{Port: &port53, Protocol: &udp}},
+			testEndpoint("web-4", "node-a", &ready, "10.244.0.2"),
+		),
+		endpointSlice("other-abcde", "other", []discovery.EndpointPort{{Port: &port8080}},
+			testEndpoint("other-1", "node-a", &ready, "10.244.0.9"),
+		),
+	)}
+
+	// Endpoints that aren't ready and ports without a number are skipped, a port without a protocol is TCP
+	webPorts := []podPort{{Name: "http", Port: 8080, Protocol: "TCP"}, {Name: "metrics", Port: 9090, Protocol: "TCP"}}
+	want := []podBackend{
+		{Address: "10.244.0.1", Pod: "web-1", Ports: webPorts},
+		{Address: "10.244.0.2", Pod: "web-4", Ports: []podPort{{Port: 53, Protocol: "UDP"}}},
+		{Address: "10.244.1.1", Pod: "web-2", Ports: webPorts},
+	}
+	if got := plb.podBackends(loadBalancerService("web")); !reflect.DeepEqual(got, want) {
+		t.Errorf("podBackends() = %v, want %v", got, want)
+	}
+}
+
+func TestSyncLoadBalancerPodBackends(t *testing.T) {
+	port := int32(8080)
+	service := loadBalancerService("web")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	plb.endpointSliceLister = endpointSlices(endpointSlice("web-abcde", "web", []discovery.EndpointPort{{Port: &port}}, testEndpoint("web-1", "node-a", nil, "10.244.0.1")))
+
+	// Pods are only published once the service asks for them
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := recordedServices(t, client, "default")["uid-web"].PodBackends; got != nil {
+		t.Errorf("syncLoadBalancer() recorded pod backends = %v, want none", got)
+	}
+
+	service.Annotations = map[string]string{PodBackendsAnnotation: "true"}
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	want := []podBackend{{Address: "10.244.0.1", Pod: "web-1", Ports: []podPort{{Port: 8080, Protocol: "TCP"}}}}
+	if got := recordedServices(t, client, "default")["uid-web"].PodBackends; !reflect.DeepEqual(got, want) {
+		t.Errorf("syncLoadBalancer() recorded pod backends = %v, want %v", got, want)
+	}
+}
+
+// hookedSlices - an EndpointSlice lister that calls listed once a list has been read, if it is set
+type hookedSlices struct {
+	discoverylisters.EndpointSliceLister
+	listed *func()
+}
+
+func (l hookedSlices) EndpointSlices(namespace string) discoverylisters.EndpointSliceNamespaceLister {
+	return hookedNamespaceSlices{l.EndpointSliceLister.EndpointSlices(namespace), l.listed}
+}
+
+type hookedNamespaceSlices struct {
+	discoverylisters.EndpointSliceNamespaceLister
+	listed *func()
+}
+
+func (l hookedNamespaceSlices) List(selector labels.Selector) ([]*discovery.EndpointSlice, error) {
+	slices, err := l.EndpointSliceNamespaceLister.List(selector)
+	if listed := *l.listed; listed != nil {
+		*l.listed = nil
+		listed()
+	}
+	return slices, err
+}
+
+func TestEndpointsChangedDuringSync(t *testing.T) {
+	port := int32(8080)
+	service := loadBalancerService("web")
+	service.Annotations = map[string]string{PodBackendsAnnotation: "true"}
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	services.Add(service.DeepCopy())
+	plb.serviceLister = corelisters.NewServiceLister(services)
+	slices := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	slices.Add(endpointSlice("web-abcde", "web", []discovery.EndpointPort{{Port: &port}}, testEndpoint("web-1", "node-a", nil, "10.244.0.1")))
+	var listed func()
+	plb.endpointSliceLister = hookedSlices{discoverylisters.NewEndpointSliceLister(slices), &listed}
+	nodes := []*v1.Node{testNode("node-a", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"})}
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nodes); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	// A pod is added without an update being handled, so that the next sync changes the pod backends
+	slices.Update(endpointSlice("web-abcde", "web", []discovery.EndpointPort{{Port: &port}},
+		testEndpoint("web-1", "node-a", nil, "10.244.0.1"),
+		testEndpoint("web-2", "node-a", nil, "10.244.0.2"),
+	))
+	// Another pod is added once the sync has read the endpoints, and the update is handled before the sync writes its
+	// record unless it has to wait for the sync
+	done := make(chan struct{})
+	listed = func() {
+		slices.Update(endpointSlice("web-abcde", "web", []discovery.EndpointPort{{Port: &port}},
+			testEndpoint("web-1", "node-a", nil, "10.244.0.1"),
+			testEndpoint("web-2", "node-a", nil, "10.244.0.2"),
+			testEndpoint("web-3", "node-a", nil, "10.244.0.3"),
+		))
+		go func() {
+			defer close(done)
+			plb.endpointsChanged("default", "web")
+		}()
+		select {
+		case <-done:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	service.Spec.Ports[0].Port = 81
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nodes); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	<-done
+
+	// Neither the sync's ports nor the added pod are lost
+	record := recordedServices(t, client, "default")["uid-web"]
+	if record.Port != 81 {
+		t.Errorf("recorded port = %d, want 81", record.Port)
+	}
+	if len(record.PodBackends) != 3 {
+		t.Errorf("recorded pod backends = %v, want web-1, web-2 and web-3", record.PodBackends)
+	}
+}
@@ -2,17 +2,38 @@ package plndrcp
 
 import (
 	"encoding/json"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
 )
 
+// configMapBackoff - how often an update of the services configuration is retried when the configMap has been changed
+// by someone else, it is jittered so that concurrent updates spread out
+var configMapBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1.0,
+}
+
 // Services functions - once the service data is taken from teh configMap, these functions will interact with the data
 
 func (s *plndrServices) addService(newSvc services) {
 	s.Services = append(s.Services, newSvc)
 }
 
+// setService - replaces the service with the same UID, or adds it
+func (s *plndrServices) setService(svc services) {
+	if existing := s.findService(svc.UID); existing != nil {
+		*existing = svc
+		return
+	}
+	s.addService(svc)
+}
+
 func (s *plndrServices) findService(UID string) *services {
 	for x := range s.Services {
 		if s.Services[x].UID == UID {
@@ -22,6 +43,21 @@ func (s *plndrServices) findService(UID string) *services {
 	return nil
 }
 
+// addressCount - returns the number of distinct addresses held by the services, shared addresses are counted once
+func (s *plndrServices) addressCount() int {
+	seen := map[string]bool{}
+	for x := range s.Services {
+		for _, address := range s.Services[x].addresses() {
+			if address == dhcpAddress {
+				// Leased addresses don't come from a pool
+				continue
+			}
+			seen[address] = true
+		}
+	}
+	return len(seen)
+}
+
 func (s *plndrServices) delServiceFromUID(UID string) *plndrServices {
 	// New Services list
 	updatedServices := &plndrServices{}
@@ -46,6 +82,60 @@ func (s *plndrServices) updateServices(vip, name, uid string) string {
 	return string(b)
 }
 
+// servicePorts - returns every port of a service, with its protocol, name and node port
+func servicePorts(service *v1.Service) []servicePort {
+	ports := make([]servicePort, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, servicePort{
+			Name:     port.Name,
+			Port:     int(port.Port),
+			Protocol: string(port.Protocol),
+			NodePort: int(port.NodePort),
+		})
+	}
+	return ports
+}
+
+// addresses - returns every address held by a service
+func (s *services) addresses() []string {
+	if len(s.Vips) != 0 {
+		return s.Vips
+	}
+	return []string{s.Vip}
+}
+
+// loadBalancerStatus - returns a status with an ingress entry for each address held by a service. The DHCP placeholder
+// address is replaced by the address leased for the service, which kube-vip sets in the service's status.
+func (s *services) loadBalancerStatus(service *v1.Service) *v1.LoadBalancerStatus {
+	status := &v1.LoadBalancerStatus{}
+	for _, vip := range s.addresses() {
+		if vip != dhcpAddress {
+			status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: vip})
+			continue
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" && ingress.IP != dhcpAddress && !containsAddress(s.addresses(), ingress.IP) {
+				status.Ingress = append(status.Ingress, ingress)
+			}
+		}
+	}
+	return status
+}
+
+// setTrafficPolicy - records the service's external traffic policy (only Local is recorded) and health check node port,
+// returning if either changed
+func (s *services) setTrafficPolicy(service *v1.Service) bool {
+	var policy string
+	var healthCheckNodePort int
+	if service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		policy = string(service.Spec.ExternalTrafficPolicy)
+		healthCheckNodePort = int(service.Spec.HealthCheckNodePort)
+	}
+	changed := s.ExternalTrafficPolicy != policy || s.HealthCheckNodePort != healthCheckNodePort
+	s.ExternalTrafficPolicy, s.HealthCheckNodePort = policy, healthCheckNodePort
+	return changed
+}
+
 // ConfigMap functions - these wrap all interactions with the kubernetes configmaps
 
 func (plb *plndrLoadBalancerManager) GetServices(cm *v1.ConfigMap) (svcs *plndrServices, err error) {
@@ -92,3 +182,24 @@ func (plb *plndrLoadBalancerManager) UpdateConfigMap(cm *v1.ConfigMap, s *plndrS
 	// Return results of configMap create
 	return plb.kubeClient.CoreV1().ConfigMaps(cm.Namespace).Update(cm)
 }
+
+// modifyServices - applies a change to the services configuration of a namespace. If the configMap is updated by someone
+// else in the meantime, it is read again and the change applied again, so that neither update is lost.
+func (plb *plndrLoadBalancerManager) modifyServices(namespace string, change func(svc *plndrServices) error) error {
+	return retry.RetryOnConflict(configMapBackoff, func() error {
+		cm, err := plb.GetConfigMap(PlunderClientConfig, namespace)
+		if err != nil {
+			return err
+		}
+		svc, err := plb.GetServices(cm)
+		if err != nil || svc == nil {
+			// There is no services configuration yet
+			svc = &plndrServices{}
+		}
+		if err = change(svc); err != nil {
+			return err
+		}
+		_, err = plb.UpdateConfigMap(cm, svc)
+		return err
+	})
+}
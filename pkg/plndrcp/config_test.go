@@ -0,0 +1,244 @@
+package plndrcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var configMapResource = v1.SchemeGroupVersion.WithResource("configmaps")
+
+// newTestLoadBalancer - returns a load balancer using a fake clientset, whose configMap updates fail with a conflict
+// if the configMap has changed since it was read (as the API server does)
+func newTestLoadBalancer(objects ...runtime.Object) (*plndrLoadBalancerManager, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+
+	var mu sync.Mutex
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update := action.(k8stesting.UpdateAction)
+		cm := update.GetObject().(*v1.ConfigMap).DeepCopy()
+
+		mu.Lock()
+		defer mu.Unlock()
+		obj, err := client.Tracker().Get(configMapResource, update.GetNamespace(), cm.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		current := obj.(*v1.ConfigMap)
+		if current.ResourceVersion != cm.ResourceVersion {
+			return true, nil, apierrors.NewConflict(configMapResource.GroupResource(), cm.Name, fmt.Errorf("the object has been modified"))
+		}
+		version, _ := strconv.Atoi(current.ResourceVersion)
+		cm.ResourceVersion = strconv.Itoa(version + 1)
+		return true, cm, client.Tracker().Update(configMapResource, cm, update.GetNamespace())
+	})
+	return newLoadBalancer(client, "default", PlunderCloudConfig, ""), client
+}
+
+// slowConfigMapReads - delays every read of a configMap, so that concurrent syncs overlap
+func slowConfigMapReads(client *fake.Clientset) {
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(5 * time.Millisecond)
+		return false, nil, nil
+	})
+}
+
+// servicesConfigMap - returns a services configMap holding the records
+func servicesConfigMap(namespace string, records ...services) *v1.ConfigMap {
+	b, _ := json.Marshal(plndrServices{Services: records})
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PlunderClientConfig, Namespace: namespace, ResourceVersion: "1"},
+		Data:       map[string]string{PlunderServicesKey: string(b)},
+	}
+}
+
+// cloudConfig - returns the cloud configMap holding the pools and their options
+func cloudConfig(data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PlunderCloudConfig, Namespace: "kube-system", ResourceVersion: "1"},
+		Data:       data,
+	}
+}
+
+// loadBalancerService - returns a LoadBalancer service in the default namespace, exposing a single TCP port
+func loadBalancerService(name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+}
+
+// recordedServices - returns the records in a namespace's services configMap by UID
+func recordedServices(t *testing.T, client *fake.Clientset, namespace string) map[string]services {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(PlunderClientConfig, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var svc plndrServices
+	if err := json.Unmarshal([]byte(cm.Data[PlunderServicesKey]), &svc); err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]services{}
+	for _, record := range svc.Services {
+		records[record.UID] = record
+	}
+	return records
+}
+
+func TestModifyServicesConflict(t *testing.T) {
+	plb, client := newTestLoadBalancer(servicesConfigMap("default", services{UID: "uid-a", ServiceName: "a", Vip: "10.0.0.1"}))
+
+	calls := 0
+	err := plb.modifyServices("default", func(svc *plndrServices) error {
+		calls++
+		if calls == 1 {
+			// Another update of the configMap lands between this read and write
+			err := plb.modifyServices("default", func(other *plndrServices) error {
+				other.addService(services{UID: "uid-b", ServiceName: "b", Vip: "10.0.0.2"})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		svc.addService(services{UID: "uid-c", ServiceName: "c", Vip: "10.0.0.3"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("modifyServices() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("modifyServices() applied the change %d times, want 2", calls)
+	}
+	records := recordedServices(t, client, "default")
+	for _, uid := range []string{"uid-a", "uid-b", "uid-c"} {
+		if _, ok := records[uid]; !ok {
+			t.Errorf("modifyServices() lost the record of [%s], records are %v", uid, records)
+		}
+	}
+}
+
+func TestConcurrentSyncAndDelete(t *testing.T) {
+	const added, removed = 10, 5
+
+	cloudConfigMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PlunderCloudConfig, Namespace: "kube-system", ResourceVersion: "1"},
+		Data:       map[string]string{"cidr-global": "10.0.0.0/24"},
+	}
+	var existing []services
+	var deleted []*v1.Service
+	for x := 0; x < removed; x++ {
+		name := fmt.Sprintf("old-%d", x)
+		vip := fmt.Sprintf("10.0.0.%d", 200+x)
+		existing = append(existing, services{UID: "uid-" + name, ServiceName: name, Vip: vip, Pools: map[string]string{vip: "cidr-global"}})
+		deleted = append(deleted, &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)}})
+	}
+	objects := []runtime.Object{cloudConfigMap, servicesConfigMap("default", existing...)}
+	var created []*v1.Service
+	for x := 0; x < added; x++ {
+		name := fmt.Sprintf("new-%d", x)
+		service := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeLoadBalancer,
+				Ports: []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		created = append(created, service)
+		objects = append(objects, service.DeepCopy())
+	}
+
+	plb, client := newTestLoadBalancer(objects...)
+	for _, record := range existing {
+		if err := plb.ipam.ReserveAddress("cidr-global", record.Vip, record.UID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, service := range created {
+		wg.Add(1)
+		go func(service *v1.Service) {
+			defer wg.Done()
+			if _, err := plb.syncLoadBalancer(service, nil); err != nil {
+				t.Errorf("syncLoadBalancer(%s) error = %v", service.Name, err)
+			}
+		}(service)
+	}
+	for _, service := range deleted {
+		wg.Add(1)
+		go func(service *v1.Service) {
+			defer wg.Done()
+			if err := plb.deleteLoadBalancer(service); err != nil {
+				t.Errorf("deleteLoadBalancer(%s) error = %v", service.Name, err)
+			}
+		}(service)
+	}
+	wg.Wait()
+
+	records := recordedServices(t, client, "default")
+	if len(records) != added {
+		t.Errorf("Found %d records, want %d: %v", len(records), added, records)
+	}
+	addresses := map[string]string{}
+	for _, service := range created {
+		record, ok := records[string(service.UID)]
+		if !ok {
+			t.Errorf("The record of service [%s] was lost", service.Name)
+			continue
+		}
+		if other, ok := addresses[record.Vip]; ok {
+			t.Errorf("Address [%s] was given to services [%s] and [%s]", record.Vip, other, service.Name)
+		}
+		addresses[record.Vip] = service.Name
+	}
+	for _, service := range deleted {
+		if _, ok := records[string(service.UID)]; ok {
+			t.Errorf("The removal of service [%s] was lost", service.Name)
+		}
+	}
+}
+
+func Test_loadBalancerStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		record services
+		status []v1.LoadBalancerIngress
+		want   []v1.LoadBalancerIngress
+	}{
+		{name: "pool address", record: services{Vip: "10.0.0.1"}, want: []v1.LoadBalancerIngress{{IP: "10.0.0.1"}}},
+		{name: "dual stack", record: services{Vip: "10.0.0.1", Vips: []string{"10.0.0.1", "fd00::1"}}, want: []v1.LoadBalancerIngress{{IP: "10.0.0.1"}, {IP: "fd00::1"}}},
+		{name: "dhcp not yet leased", record: services{Vip: dhcpAddress}},
+		{name: "dhcp placeholder in the status", record: services{Vip: dhcpAddress}, status: []v1.LoadBalancerIngress{{IP: dhcpAddress}}},
+		{name: "dhcp leased", record: services{Vip: dhcpAddress}, status: []v1.LoadBalancerIngress{{IP: "192.168.1.50"}}, want: []v1.LoadBalancerIngress{{IP: "192.168.1.50"}}},
+		{
+			name:   "dhcp leased with a pool address",
+			record: services{Vip: dhcpAddress, Vips: []string{dhcpAddress, "fd00::1"}},
+			status: []v1.LoadBalancerIngress{{IP: "fd00::1"}, {IP: "192.168.1.50"}},
+			want:   []v1.LoadBalancerIngress{{IP: "192.168.1.50"}, {IP: "fd00::1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &v1.Service{Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: tt.status}}}
+			if got := tt.record.loadBalancerStatus(service); !reflect.DeepEqual(got.Ingress, tt.want) {
+				t.Errorf("loadBalancerStatus() = %v, want %v", got.Ingress, tt.want)
+			}
+		})
+	}
+}
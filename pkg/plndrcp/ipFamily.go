@@ -0,0 +1,80 @@
+package plndrcp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The Service API in use doesn't yet have spec.ipFamilies and spec.ipFamilyPolicy, these annotations mirror those fields.
+// spec.ipFamily isn't used, it is the family of the ClusterIP and is defaulted by the API server.
+const (
+	// IPFamiliesAnnotation - a comma seperated list of the families (IPv4/IPv6) a service wants an address from
+	IPFamiliesAnnotation = "plndr.io/ip-families"
+
+	// IPFamilyPolicyAnnotation - one of SingleStack, PreferDualStack or RequireDualStack
+	IPFamilyPolicyAnnotation = "plndr.io/ip-family-policy"
+)
+
+const (
+	// SingleStack - a single address will be allocated
+	SingleStack = "SingleStack"
+	// PreferDualStack - an address from both families is allocated where possible, falling back to a single address
+	PreferDualStack = "PreferDualStack"
+	// RequireDualStack - an address from both families must be allocated
+	RequireDualStack = "RequireDualStack"
+)
+
+// serviceFamilies - returns the families that addresses should be allocated from (in order) and if every family is required
+func serviceFamilies(service *v1.Service) ([]ipam.Family, bool, error) {
+	var families []ipam.Family
+
+	if f, ok := service.Annotations[IPFamiliesAnnotation]; ok {
+		for _, family := range strings.Split(f, ",") {
+			family = strings.TrimSpace(family)
+			switch ipam.Family(family) {
+			case ipam.IPv4, ipam.IPv6:
+			default:
+				return nil, false, fmt.Errorf("Unknown IP family [%s] in annotation [%s]", family, IPFamiliesAnnotation)
+			}
+			if len(families) != 0 && families[0] == ipam.Family(family) {
+				return nil, false, fmt.Errorf("IP family [%s] is listed twice in annotation [%s]", family, IPFamiliesAnnotation)
+			}
+			if len(families) == 2 {
+				return nil, false, fmt.Errorf("Too many IP families listed in annotation [%s]", IPFamiliesAnnotation)
+			}
+			families = append(families, ipam.Family(family))
+		}
+	}
+
+	switch policy := service.Annotations[IPFamilyPolicyAnnotation]; policy {
+	case "", SingleStack:
+		if len(families) > 1 {
+			return nil, false, fmt.Errorf("Multiple IP families requested with the [%s] policy", SingleStack)
+		}
+		if len(families) == 0 {
+			// No preference, an address of any family will do
+			families = append(families, "")
+		}
+		return families, true, nil
+	case PreferDualStack, RequireDualStack:
+		switch len(families) {
+		case 0:
+			families = []ipam.Family{ipam.IPv4, ipam.IPv6}
+		case 1:
+			families = append(families, otherFamily(families[0]))
+		}
+		return families, policy == RequireDualStack, nil
+	default:
+		return nil, false, fmt.Errorf("Unknown IP family policy [%s] in annotation [%s]", policy, IPFamilyPolicyAnnotation)
+	}
+}
+
+func otherFamily(family ipam.Family) ipam.Family {
+	if family == ipam.IPv6 {
+		return ipam.IPv4
+	}
+	return ipam.IPv6
+}
@@ -0,0 +1,54 @@
+package plndrcp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_serviceFamilies(t *testing.T) {
+	ipv6 := v1.IPv6Protocol
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		ipFamily     *v1.IPFamily
+		want         []ipam.Family
+		wantRequired bool
+		wantErr      bool
+	}{
+		{name: "no preference", want: []ipam.Family{""}, wantRequired: true},
+		{name: "single stack ipv6", annotations: map[string]string{IPFamiliesAnnotation: "IPv6", IPFamilyPolicyAnnotation: SingleStack}, want: []ipam.Family{ipam.IPv6}, wantRequired: true},
+		{name: "cluster ip family ignored", ipFamily: &ipv6, want: []ipam.Family{""}, wantRequired: true},
+		{name: "single stack with two families", annotations: map[string]string{IPFamiliesAnnotation: "IPv4,IPv6"}, wantErr: true},
+		{name: "prefer dual stack", annotations: map[string]string{IPFamilyPolicyAnnotation: PreferDualStack}, want: []ipam.Family{ipam.IPv4, ipam.IPv6}},
+		{name: "prefer dual stack ipv6 first", annotations: map[string]string{IPFamiliesAnnotation: "IPv6", IPFamilyPolicyAnnotation: PreferDualStack}, want: []ipam.Family{ipam.IPv6, ipam.IPv4}},
+		{name: "prefer dual stack ignores cluster ip family", ipFamily: &ipv6, annotations: map[string]string{IPFamilyPolicyAnnotation: PreferDualStack}, want: []ipam.Family{ipam.IPv4, ipam.IPv6}},
+		{name: "require dual stack", annotations: map[string]string{IPFamilyPolicyAnnotation: RequireDualStack}, want: []ipam.Family{ipam.IPv4, ipam.IPv6}, wantRequired: true},
+		{name: "require dual stack with both families", annotations: map[string]string{IPFamiliesAnnotation: "IPv6, IPv4", IPFamilyPolicyAnnotation: RequireDualStack}, want: []ipam.Family{ipam.IPv6, ipam.IPv4}, wantRequired: true},
+		{name: "family listed twice", annotations: map[string]string{IPFamiliesAnnotation: "IPv4,IPv4", IPFamilyPolicyAnnotation: RequireDualStack}, wantErr: true},
+		{name: "too many families", annotations: map[string]string{IPFamiliesAnnotation: "IPv4,IPv6,IPv4", IPFamilyPolicyAnnotation: RequireDualStack}, wantErr: true},
+		{name: "unknown family", annotations: map[string]string{IPFamiliesAnnotation: "IPv5"}, wantErr: true},
+		{name: "unknown policy", annotations: map[string]string{IPFamilyPolicyAnnotation: "DualStack"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       v1.ServiceSpec{IPFamily: tt.ipFamily},
+			}
+			got, required, err := serviceFamilies(service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serviceFamilies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) || required != tt.wantRequired {
+				t.Errorf("serviceFamilies() = %v, %v, want %v, %v", got, required, tt.want, tt.wantRequired)
+			}
+		})
+	}
+}
@@ -3,46 +3,147 @@ package plndrcp
 import (
 	"context"
 	"fmt"
+	"net"
+	"sync"
 
 	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1alpha1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
 )
 
+// dhcpAddress - requested as the load balancer address, the address is leased by kube-vip from DHCP rather than a pool
+const dhcpAddress = "0.0.0.0"
+
 type plndrServices struct {
 	Services []services `json:"services"`
 }
 
 type services struct {
-	Vip         string `json:"vip"`
-	Port        int    `json:"port"`
-	Type        string `json:"type"`
-	UID         string `json:"uid"`
-	ServiceName string `json:"serviceName"`
+	Vip  string   `json:"vip"`
+	Vips []string `json:"vips,omitempty"`
+	// Port and Type are the first of the ports, for clients that only read a single port
+	Port        int           `json:"port"`
+	Type        string        `json:"type"`
+	Ports       []servicePort `json:"ports,omitempty"`
+	Backends    []backend     `json:"backends,omitempty"`
+	PodBackends []podBackend  `json:"podBackends,omitempty"`
+	UID         string        `json:"uid"`
+	ServiceName string        `json:"serviceName"`
+	SharingKey  string        `json:"sharingKey,omitempty"`
+	// Pools holds the key of the pool that each address was taken from, by address
+	Pools map[string]string `json:"pools,omitempty"`
+
+	// ExternalTrafficPolicy is Local when only nodes with ready endpoints are backends, kube-proxy answers on the
+	// HealthCheckNodePort of each node with whether it has local endpoints
+	ExternalTrafficPolicy string `json:"externalTrafficPolicy,omitempty"`
+	HealthCheckNodePort   int    `json:"healthCheckNodePort,omitempty"`
+}
+
+// servicePort - a port exposed on the load balancer addresses
+type servicePort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	NodePort int    `json:"nodePort,omitempty"`
+}
+
+// backend - a ready node that traffic can be sent to, on the node port of each port
+type backend struct {
+	Node    string `json:"node"`
+	Address string `json:"address"`
+}
+
+// podBackend - a ready pod that traffic can be sent to directly, on its target ports
+type podBackend struct {
+	Address string    `json:"address"`
+	Pod     string    `json:"pod,omitempty"`
+	Ports   []podPort `json:"ports"`
+}
+
+// podPort - a port that a pod serves
+type podPort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
 }
 
-//PlndrLoadBalancer -
+// PlndrLoadBalancer -
 type plndrLoadBalancerManager struct {
-	kubeClient     *kubernetes.Clientset
+	kubeClient     kubernetes.Interface
+	recorder       record.EventRecorder
+	ipam           *ipam.Allocator
 	nameSpace      string
 	cloudConfigMap string
+	serviceCidr    string
+
+	// poolProblems holds the pools (by key) that the last validation of the cloud ConfigMap refused
+	poolsMu      sync.RWMutex
+	poolProblems map[string]string
+
+	// namespaceLister is a cache of namespaces (and their labels), it is set when the provider is initialized
+	namespaceLister  corelisters.NamespaceLister
+	namespacesSynced cache.InformerSynced
+
+	// serviceLister and endpointSliceLister are set when the provider is initialized, endpointSliceLister is only set
+	// if the cluster serves EndpointSlices
+	serviceLister       corelisters.ServiceLister
+	endpointSliceLister discoverylisters.EndpointSliceLister
+
+	// nodes are those last passed by the service controller, they are the backends when endpoints change
+	nodesMu sync.Mutex
+	nodes   []*v1.Node
+
+	// namespaceLocks serialize the syncs and removals of services within each namespace, so that a sync sees the
+	// addresses recorded by those before it when checking sharing keys and quotas
+	namespaceLocksMu sync.Mutex
+	namespaceLocks   map[string]*sync.Mutex
 }
 
-func newLoadBalancer(kubeClient *kubernetes.Clientset, ns, cm, serviceCidr string) cloudprovider.LoadBalancer {
+func newLoadBalancer(kubeClient kubernetes.Interface, ns, cm, serviceCidr string) *plndrLoadBalancerManager {
+	// Events are raised against services when there are problems with their addresses
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events(metav1.NamespaceAll)})
+
 	return &plndrLoadBalancerManager{
 		kubeClient:     kubeClient,
+		recorder:       broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ProviderName + "-cloud-provider"}),
+		ipam:           ipam.NewAllocator(),
 		nameSpace:      ns,
 		cloudConfigMap: cm,
+		serviceCidr:    serviceCidr,
+		namespaceLocks: map[string]*sync.Mutex{},
 	}
 }
 
+// lockNamespace - holds the lock of a namespace, the returned function releases it
+func (plb *plndrLoadBalancerManager) lockNamespace(namespace string) func() {
+	plb.namespaceLocksMu.Lock()
+	lock, ok := plb.namespaceLocks[namespace]
+	if !ok {
+		lock = &sync.Mutex{}
+		plb.namespaceLocks[namespace] = lock
+	}
+	plb.namespaceLocksMu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 func (plb *plndrLoadBalancerManager) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (lbs *v1.LoadBalancerStatus, err error) {
-	return plb.syncLoadBalancer(service)
+	return plb.syncLoadBalancer(service, nodes)
 }
 func (plb *plndrLoadBalancerManager) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (err error) {
-	_, err = plb.syncLoadBalancer(service)
+	_, err = plb.syncLoadBalancer(service, nodes)
 	return err
 }
 
@@ -64,18 +165,8 @@ func (plb *plndrLoadBalancerManager) GetLoadBalancer(ctx context.Context, cluste
 		return nil, false, err
 	}
 
-	for x := range svc.Services {
-		if svc.Services[x].UID == string(service.UID) {
-			return &service.Status.LoadBalancer, true, nil
-
-			// return &v1.LoadBalancerStatus{
-			// 	Ingress: []v1.LoadBalancerIngress{
-			// 		{
-			// 			IP: svc.Services[x].Vip,
-			// 		},
-			// 	},
-			// }, true, nil
-		}
+	if existing := svc.findService(string(service.UID)); existing != nil {
+		return existing.loadBalancerStatus(service), true, nil
 	}
 	return nil, false, nil
 }
@@ -92,34 +183,37 @@ func getDefaultLoadBalancerName(service *v1.Service) string {
 
 func (plb *plndrLoadBalancerManager) deleteLoadBalancer(service *v1.Service) error {
 	klog.Infof("deleting service '%s' (%s)", service.Name, service.UID)
+	defer plb.lockNamespace(service.Namespace)()
 
 	// Get the kube-vip (client) configuration from it's namespace
-	cm, err := plb.GetConfigMap(PlunderClientConfig, service.Namespace)
-	if err != nil {
+	if _, err := plb.GetConfigMap(PlunderClientConfig, service.Namespace); err != nil {
 		klog.Errorf("The configMap [%s] doensn't exist", PlunderClientConfig)
 		return nil
 	}
-	// Find the services configuraiton in the configMap
-	svc, err := plb.GetServices(cm)
-	if err != nil {
-		klog.Errorf("The service [%s] in configMap [%s] doensn't exist", service.Name, PlunderClientConfig)
+
+	// Update the services configuration, by removing the service
+	var removed *services
+	err := plb.modifyServices(service.Namespace, func(svc *plndrServices) error {
+		removed = svc.findService(string(service.UID))
+		*svc = *svc.delServiceFromUID(string(service.UID))
 		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Update the services configuration, by removing the  service
-	updatedSvc := svc.delServiceFromUID(string(service.UID))
-	if len(service.Status.LoadBalancer.Ingress) != 0 {
-		err = ipam.ReleaseAddress(service.Namespace, service.Spec.LoadBalancerIP)
-		if err != nil {
-			klog.Errorln(err)
-		}
+	// Release every address held by the service, those shared with other services stay in use
+	if removed != nil {
+		plb.releaseAddresses(plb.recordPools(nil, removed, service), service, removed.addresses())
 	}
-	// Update the configMap
-	_, err = plb.UpdateConfigMap(cm, updatedSvc)
-	return err
+	return nil
 }
 
-func (plb *plndrLoadBalancerManager) syncLoadBalancer(service *v1.Service) (*v1.LoadBalancerStatus, error) {
+func (plb *plndrLoadBalancerManager) syncLoadBalancer(service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	plb.setNodes(nodes)
+
+	// The records of the namespace are read, checked and written without another sync or removal in between
+	defer plb.lockNamespace(service.Namespace)()
 
 	// Get the clound controller configuration map
 	controllerCM, err := plb.GetConfigMap(PlunderCloudConfig, "kube-system")
@@ -155,118 +249,237 @@ func (plb *plndrLoadBalancerManager) syncLoadBalancer(service *v1.Service) (*v1.
 		svc = &plndrServices{}
 	}
 
+	if len(service.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("Service [%s] has no ports to load balance", service.Name)
+	}
+
+	// A requested address is reserved and recorded in the form that ipam holds addresses
+	if requested := service.Spec.LoadBalancerIP; requested != "" {
+		normalized, err := ipam.NormalizeAddress(requested)
+		if err != nil {
+			plb.recorder.Eventf(service, v1.EventTypeWarning, "InvalidLoadBalancerIP", "Requested address [%s] can't be used: %v", requested, err)
+			return nil, fmt.Errorf("Requested address [%s] for service [%s] can't be used: %v", requested, service.Name, err)
+		}
+		service.Spec.LoadBalancerIP = normalized
+	}
+
 	// Check for existing configuration
 
 	existing := svc.findService(string(service.UID))
 	if existing != nil {
 		klog.Infof("found existing service '%s' (%s) with vip %s", service.Name, service.UID, existing.Vip)
-		return &service.Status.LoadBalancer, nil
-
-		// If this is 0.0.0.0 then it's a DHCP lease and we need to return that not the 0.0.0.0
-		// if existing.Vip == "0.0.0.0" {
-		// 	return &service.Status.LoadBalancer, nil
-		// }
-
-		// //
-		// return &v1.LoadBalancerStatus{
-		// 	Ingress: []v1.LoadBalancerIngress{
-		// 		{
-		// 			IP: existing.Vip,
-		// 		},
-		// 	},
-		// }, nil
+		return plb.reconcileLoadBalancer(controllerCM, svc, existing, service, nodes)
+	}
+
+	families, required, err := serviceFamilies(service)
+	if err != nil {
+		return nil, err
+	}
+
+	// vips holds every address for the service, allocated holds those marked as used in ipam by this sync
+	var vips, allocated []string
+
+	// Services sharing a key take the addresses (and pools) of the first service to use it, pools holds the key of the
+	// pool of each address
+	pools := map[string]string{}
+	sharingKey := service.Annotations[SharedIPAnnotation]
+	if sharingKey != "" {
+		sharer, err := plb.sharedAddresses(svc, service, sharingKey)
+		if err != nil {
+			return nil, err
+		}
+		if sharer != nil {
+			vips = sharer.addresses()
+			pools = plb.recordPools(controllerCM, sharer, service)
+		}
+	}
+	shared := len(vips) != 0
+	dhcp := !shared && service.Spec.LoadBalancerIP == dhcpAddress
+
+	// Each family's addresses may come from a different pool, the pool of the first address is found before the quota
+	// is checked
+	familyPools := map[ipam.Family]addressPool{}
+	var pool addressPool
+	if !shared && !dhcp {
+		first := families[0]
+		if service.Spec.LoadBalancerIP != "" {
+			first = ipam.AddressFamily(service.Spec.LoadBalancerIP)
+		}
+		pool, err = plb.familyPool(controllerCM, service, first)
+		if err != nil {
+			return nil, err
+		}
+		familyPools[first] = pool
+		// Shared addresses are already counted against the namespace's quota
+		families, err = plb.applyQuota(controllerCM, svc, service, families, required)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if service.Spec.LoadBalancerIP == "" {
-		service.Spec.LoadBalancerIP, err = discoverAddress(controllerCM, service.Namespace, plb.cloudConfigMap)
+	switch {
+	case shared:
+		if service.Spec.LoadBalancerIP != "" && !containsAddress(vips, service.Spec.LoadBalancerIP) {
+			return nil, fmt.Errorf("Service [%s] requests address [%s], but services sharing [%s] use %v", service.Name, service.Spec.LoadBalancerIP, sharingKey, vips)
+		}
+		// The addresses are already in use by the services sharing them, this service becomes another owner
+		for _, vip := range vips {
+			if vip == dhcpAddress {
+				continue
+			}
+			if err := plb.ipam.ShareAddress(pools[vip], vip, string(service.UID)); err != nil {
+				plb.releaseAddresses(pools, service, allocated)
+				return nil, fmt.Errorf("Service [%s] can't share addresses with key [%s]: %v", service.Name, sharingKey, err)
+			}
+			allocated = append(allocated, vip)
+		}
+		klog.Infof("Service [%s] is sharing addresses %v with key [%s]", service.Name, vips, sharingKey)
+	case dhcp:
+		// The address isn't taken from a pool, kube-vip will lease one
+		klog.Infof("Service [%s] will be given an address by DHCP", service.Name)
+		vips = append(vips, dhcpAddress)
+	case service.Spec.LoadBalancerIP != "":
+		if err = plb.requestedAddress(pool, service, service.Spec.LoadBalancerIP); err != nil {
+			return nil, err
+		}
+		vips = append(vips, service.Spec.LoadBalancerIP)
+		allocated = append(allocated, service.Spec.LoadBalancerIP)
+		pools[service.Spec.LoadBalancerIP] = pool.key
+	case service.Annotations[ReservationAnnotation] != "":
+		vip, err := plb.reservedAddress(pool, service, service.Annotations[ReservationAnnotation])
+		if err != nil {
+			return nil, err
+		}
+		vips = append(vips, vip)
+		allocated = append(allocated, vip)
+		pools[vip] = pool.key
+	}
+	for _, family := range families {
+		if shared || dhcp || len(vips) == len(families) {
+			break
+		}
+		if hasFamily(vips, family) {
+			continue
+		}
+		var vip string
+		pool, ok := familyPools[family]
+		err = nil
+		if !ok {
+			pool, err = plb.familyPool(controllerCM, service, family)
+		}
+		if err == nil {
+			vip, err = plb.discoverAddress(controllerCM, pool, service, family)
+		}
 		if err != nil {
+			if !required && len(vips) != 0 {
+				klog.Warningf("Unable to allocate an %s address for service [%s], continuing with a single address: %v", family, service.Name, err)
+				continue
+			}
+			plb.releaseAddresses(pools, service, allocated)
 			return nil, err
 		}
+		vips = append(vips, vip)
+		allocated = append(allocated, vip)
+		pools[vip] = pool.key
 	}
+	service.Spec.LoadBalancerIP = vips[0]
 
-	// TODO - manage more than one set of ports
 	newSvc := services{
 		ServiceName: service.Name,
 		UID:         string(service.UID),
 		Type:        string(service.Spec.Ports[0].Protocol),
 		Vip:         service.Spec.LoadBalancerIP,
 		Port:        int(service.Spec.Ports[0].Port),
+		Ports:       servicePorts(service),
+		SharingKey:  sharingKey,
 	}
+	if len(vips) > 1 {
+		newSvc.Vips = vips
+	}
+	if len(pools) != 0 {
+		newSvc.Pools = pools
+	}
+	newSvc.setTrafficPolicy(service)
+	plb.setBackends(&newSvc, service, nodes)
 
 	klog.Infof("Updating service [%s], with load balancer address [%s]", service.Name, service.Spec.LoadBalancerIP)
 	_, err = plb.kubeClient.CoreV1().Services(service.Namespace).Update(service)
 	if err != nil {
-		// release the address internally as we failed to update service
-		ipamerr := ipam.ReleaseAddress(service.Namespace, service.Spec.LoadBalancerIP)
-		if ipamerr != nil {
-			klog.Errorln(ipamerr)
-		}
+		// release the addresses internally as we failed to update service
+		plb.releaseAddresses(pools, service, allocated)
 		return nil, fmt.Errorf("Error updating Service Spec [%s] : %v", service.Name, err)
 	}
 
-	svc.addService(newSvc)
-
-	namespaceCM, err = plb.UpdateConfigMap(namespaceCM, svc)
+	err = plb.modifyServices(service.Namespace, func(svc *plndrServices) error {
+		svc.setService(newSvc)
+		return nil
+	})
 	if err != nil {
+		// release the addresses internally, the next sync will request them again from the service spec
+		plb.releaseAddresses(pools, service, allocated)
 		return nil, err
 	}
-	return &service.Status.LoadBalancer, nil
-
-	// return &v1.LoadBalancerStatus{
-	// 	Ingress: []v1.LoadBalancerIngress{
-	// 		{
-	// 			IP: vip,
-	// 		},
-	// 	},
-	// }, nil
+	return newSvc.loadBalancerStatus(service), nil
 }
 
-func discoverAddress(cm *v1.ConfigMap, namespace, configMapName string) (vip string, err error) {
-	var cidr, ipRange string
-	var ok bool
-
-	// Find Cidr
-	cidrKey := fmt.Sprintf("cidr-%s", namespace)
-	// Lookup current namespace
-	if cidr, ok = cm.Data[cidrKey]; !ok {
-		klog.Info(fmt.Errorf("No cidr config for namespace [%s] exists in key [%s] configmap [%s]", namespace, cidrKey, configMapName))
-		// Lookup global cidr configmap data
-		if cidr, ok = cm.Data["cidr-global"]; !ok {
-			klog.Info(fmt.Errorf("No global cidr config exists [cidr-global]"))
-		} else {
-			klog.Infof("Taking address from [cidr-global] pool")
+// releaseAddresses - releases the service's hold on addresses in their ipam pools (keyed by address), they are returned
+// to the pool once no other service holds them
+func (plb *plndrLoadBalancerManager) releaseAddresses(pools map[string]string, service *v1.Service, addresses []string) {
+	key := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+	for x := range addresses {
+		if addresses[x] == dhcpAddress {
+			continue
 		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", cidrKey)
-	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromCidr(namespace, cidr)
-		if err != nil {
-			return "", err
+		if err := plb.ipam.ReleaseAddress(pools[addresses[x]], addresses[x], string(service.UID), key); err != nil {
+			klog.Errorln(err)
 		}
-		return
 	}
+}
 
-	// Find Range
-	rangeKey := fmt.Sprintf("range-%s", namespace)
-	// Lookup current namespace
-	if ipRange, ok = cm.Data[rangeKey]; !ok {
-		klog.Info(fmt.Errorf("No range config for namespace [%s] exists in key [%s] configmap [%s]", namespace, rangeKey, configMapName))
-		// Lookup global range configmap data
-		if ipRange, ok = cm.Data["range-global"]; !ok {
-			klog.Info(fmt.Errorf("No global range config exists [range-global]"))
-		} else {
-			klog.Infof("Taking address from [range-global] pool")
+// containsAddress - checks if the address is in the list of addresses, they are compared as addresses as a record may
+// hold an address in another form
+func containsAddress(addresses []string, address string) bool {
+	ip := net.ParseIP(address)
+	for x := range addresses {
+		if addresses[x] == address || (ip != nil && ip.Equal(net.ParseIP(addresses[x]))) {
+			return true
 		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", rangeKey)
 	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromRange(namespace, ipRange)
-		if err != nil {
-			return vip, err
+	return false
+}
+
+// hasFamily - checks if any of the addresses are of the family
+func hasFamily(addresses []string, family ipam.Family) bool {
+	for x := range addresses {
+		if family == "" || ipam.AddressFamily(addresses[x]) == family {
+			return true
 		}
-		return
 	}
-	return "", fmt.Errorf("No IP address ranges could be found either range-global or range-<namespace>")
+	return false
+}
+
+func (plb *plndrLoadBalancerManager) discoverAddress(cm *v1.ConfigMap, pool addressPool, service *v1.Service, family ipam.Family) (vip string, err error) {
+	req, err := addressRequest(cm, pool.key, service, family)
+	if err != nil {
+		return "", err
+	}
+	return pool.find(plb.ipam, req)
+}
+
+// reservedAddress - marks and returns the address of a named reservation in the service's pool
+func (plb *plndrLoadBalancerManager) reservedAddress(pool addressPool, service *v1.Service, name string) (string, error) {
+	vip, err := ipam.Reservation(pool.definition, name)
+	if err != nil {
+		return "", fmt.Errorf("Unable to find reservation for service [%s] in pool [%s]: %v", service.Name, pool.key, err)
+	}
+	return vip, plb.requestedAddress(pool, service, vip)
+}
+
+// requestedAddress - checks that an address asked for by a service is within its pool and unused, then marks it as used
+func (plb *plndrLoadBalancerManager) requestedAddress(pool addressPool, service *v1.Service, vip string) error {
+	if err := pool.reserve(plb.ipam, vip, string(service.UID)); err != nil {
+		plb.recorder.Eventf(service, v1.EventTypeWarning, "InvalidLoadBalancerIP", "Requested address [%s] can't be used from pool [%s]: %v", vip, pool.key, err)
+		return fmt.Errorf("Requested address [%s] for service [%s] can't be used: %v", vip, service.Name, err)
+	}
+	return nil
 }
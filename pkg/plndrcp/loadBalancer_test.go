@@ -0,0 +1,126 @@
+package plndrcp
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSyncLoadBalancerRequestedAddressForm(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Spec.LoadBalancerIP = "FD00::0005"
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "fd00::/120"}), service.DeepCopy())
+
+	status, err := plb.syncLoadBalancer(service.DeepCopy(), nil)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := status.Ingress[0].IP; got != "fd00::5" {
+		t.Errorf("syncLoadBalancer() ingress = %v, want fd00::5", got)
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vip; got != "fd00::5" {
+		t.Errorf("syncLoadBalancer() recorded vip = %v, want fd00::5", got)
+	}
+
+	// A second sync of the unchanged service keeps its address
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if err := plb.deleteLoadBalancer(service); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if err := plb.ipam.ReserveAddress("cidr-global", "fd00::5", "uid-b"); err != nil {
+		t.Errorf("The address wasn't released with the service: %v", err)
+	}
+}
+
+func TestSyncLoadBalancerDualStack(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Annotations = map[string]string{IPFamiliesAnnotation: "IPv6", IPFamilyPolicyAnnotation: RequireDualStack}
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24,fd00::/120"}), service.DeepCopy())
+
+	status, err := plb.syncLoadBalancer(service.DeepCopy(), nil)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	want := []v1.LoadBalancerIngress{{IP: "fd00::1"}, {IP: "10.0.0.1"}}
+	if !reflect.DeepEqual(status.Ingress, want) {
+		t.Errorf("syncLoadBalancer() ingress = %v, want %v", status.Ingress, want)
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vips; !reflect.DeepEqual(got, []string{"fd00::1", "10.0.0.1"}) {
+		t.Errorf("syncLoadBalancer() recorded vips = %v, want [fd00::1 10.0.0.1]", got)
+	}
+}
+
+func TestSyncLoadBalancerDualStackPools(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Annotations = map[string]string{IPFamilyPolicyAnnotation: RequireDualStack}
+	cm := cloudConfig(map[string]string{"cidr-default": "10.0.0.0/24", "range-default": "fd00::1-fd00::ff"})
+	plb, client := newTestLoadBalancer(cm, service.DeepCopy())
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	// Each family is taken from the first pool that holds addresses of it
+	record := recordedServices(t, client, "default")["uid-a"]
+	want := map[string]string{"10.0.0.1": "cidr-default", "fd00::1": "range-default"}
+	if !reflect.DeepEqual(record.Pools, want) {
+		t.Errorf("syncLoadBalancer() recorded pools = %v, want %v", record.Pools, want)
+	}
+
+	if err := plb.deleteLoadBalancer(service); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	for address, poolKey := range want {
+		if err := plb.ipam.ReserveAddress(poolKey, address, "uid-b"); err != nil {
+			t.Errorf("Address [%s] wasn't released to pool [%s] with the service: %v", address, poolKey, err)
+		}
+	}
+}
+
+func TestSyncLoadBalancerPorts(t *testing.T) {
+	service := loadBalancerService("dns")
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP, NodePort: 30053},
+		{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP, NodePort: 31053},
+	}
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	record := recordedServices(t, client, "default")["uid-dns"]
+	want := []servicePort{
+		{Name: "dns-udp", Port: 53, Protocol: "UDP", NodePort: 30053},
+		{Name: "dns-tcp", Port: 53, Protocol: "TCP", NodePort: 31053},
+	}
+	if !reflect.DeepEqual(record.Ports, want) {
+		t.Errorf("syncLoadBalancer() recorded ports = %v, want %v", record.Ports, want)
+	}
+	// Clients that only read a single port see the first
+	if record.Port != 53 || record.Type != "UDP" {
+		t.Errorf("syncLoadBalancer() recorded port = %d/%s, want 53/UDP", record.Port, record.Type)
+	}
+}
+
+func TestSyncLoadBalancerDHCP(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Spec.LoadBalancerIP = dhcpAddress
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+
+	status, err := plb.syncLoadBalancer(service.DeepCopy(), nil)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if len(status.Ingress) != 0 {
+		t.Errorf("syncLoadBalancer() ingress = %v, want none until kube-vip leases an address", status.Ingress)
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vip; got != dhcpAddress {
+		t.Errorf("syncLoadBalancer() recorded vip = %v, want %v", got, dhcpAddress)
+	}
+	// No address was taken from the pool
+	if err := plb.ipam.ReserveHostFromCidr("cidr-global", "10.0.0.0/24", "10.0.0.1", "uid-b"); err != nil {
+		t.Errorf("ReserveHostFromCidr() error = %v, the pool should be unused", err)
+	}
+}
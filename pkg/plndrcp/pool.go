@@ -0,0 +1,292 @@
+package plndrcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// AddressPoolAnnotation - selects a named pool (defined by a pool-<name> key in the cloud ConfigMap) for the service
+const AddressPoolAnnotation = "plndr.io/address-pool"
+
+// ReservationAnnotation - names a reservation (name=address) in the service's pool that the service should be given
+const ReservationAnnotation = "plndr.io/reservation"
+
+// Options for a pool are set in the cloud ConfigMap under the pool's key followed by the option name,
+// e.g. cidr-global.strategy: random
+const (
+	// strategyOption - how an address is picked from the pool (lowest, highest, random or hash)
+	strategyOption = "strategy"
+	// namespaceSelectorOption - a label selector, services in namespaces whose labels match take addresses from the
+	// (named) pool
+	namespaceSelectorOption = "namespaceSelector"
+	// quarantineOption - how long a released address is held back before it is handed out again (e.g. 5m)
+	quarantineOption = "quarantine"
+	// retentionOption - how long the address of a deleted service is kept for it, should it be recreated (e.g. 1h)
+	retentionOption = "retention"
+)
+
+// poolOption - returns the value of an option for a pool
+func poolOption(cm *v1.ConfigMap, poolKey, option string) string {
+	return cm.Data[fmt.Sprintf("%s.%s", poolKey, option)]
+}
+
+// addressRequest - builds the ipam request for an address of the family, for a service being given an address from a pool
+func addressRequest(cm *v1.ConfigMap, poolKey string, service *v1.Service, family ipam.Family) (ipam.Request, error) {
+	strategy, err := ipam.ParseStrategy(poolOption(cm, poolKey, strategyOption))
+	if err != nil {
+		return ipam.Request{}, fmt.Errorf("Invalid configuration for pool [%s]: %v", poolKey, err)
+	}
+	quarantine, err := parsePeriod(poolOption(cm, poolKey, quarantineOption))
+	if err != nil {
+		return ipam.Request{}, fmt.Errorf("Invalid configuration for pool [%s]: %v", poolKey, err)
+	}
+	retention, err := parsePeriod(poolOption(cm, poolKey, retentionOption))
+	if err != nil {
+		return ipam.Request{}, fmt.Errorf("Invalid configuration for pool [%s]: %v", poolKey, err)
+	}
+	return ipam.Request{
+		Family:     family,
+		Strategy:   strategy,
+		Key:        fmt.Sprintf("%s/%s", service.Namespace, service.Name),
+		Owner:      string(service.UID),
+		Quarantine: quarantine,
+		Retention:  retention,
+	}, nil
+}
+
+// parsePeriod - parses a period option of a pool (quarantine or retention), no period disables the option
+func parsePeriod(period string) (time.Duration, error) {
+	if period == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid period [%s]", period)
+	}
+	return d, nil
+}
+
+// addressPool - a pool of addresses defined in the cloud ConfigMap, the pool's key is also the name ipam manages it under
+type addressPool struct {
+	key        string
+	definition string
+}
+
+// find - returns a free address from the pool
+func (p addressPool) find(a *ipam.Allocator, req ipam.Request) (string, error) {
+	switch {
+	case strings.HasPrefix(p.key, "cidr-"):
+		return a.FindAvailableHostFromCidr(p.key, p.definition, req)
+	case strings.HasPrefix(p.key, "range-"):
+		return a.FindAvailableHostFromRange(p.key, p.definition, req)
+	default:
+		return a.FindAvailableHostFromPool(p.key, p.definition, req)
+	}
+}
+
+// reserve - marks a specific address from the pool as used by the owner
+func (p addressPool) reserve(a *ipam.Allocator, address, owner string) error {
+	switch {
+	case strings.HasPrefix(p.key, "cidr-"):
+		return a.ReserveHostFromCidr(p.key, p.definition, address, owner)
+	case strings.HasPrefix(p.key, "range-"):
+		return a.ReserveHostFromRange(p.key, p.definition, address, owner)
+	default:
+		return a.ReserveHostFromPool(p.key, p.definition, address, owner)
+	}
+}
+
+// ipamPool - returns the pool's definition for ipam
+func (p addressPool) ipamPool() ipam.Pool {
+	switch {
+	case strings.HasPrefix(p.key, "cidr-"):
+		return ipam.NewCidrPool(p.key, p.definition)
+	case strings.HasPrefix(p.key, "range-"):
+		return ipam.NewRangePool(p.key, p.definition)
+	default:
+		return ipam.NewMixedPool(p.key, p.definition)
+	}
+}
+
+// validate - checks that the pool's definition can be parsed
+func (p addressPool) validate() error {
+	var err error
+	switch {
+	case strings.HasPrefix(p.key, "cidr-"):
+		err = ipam.ValidateCidr(p.definition)
+	case strings.HasPrefix(p.key, "range-"):
+		err = ipam.ValidateRange(p.definition)
+	default:
+		err = ipam.ValidatePool(p.definition)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid definition [%s]: %v", p.definition, err)
+	}
+	return nil
+}
+
+// findPool - returns the pool that a service's addresses of the family are taken from, a named pool selected by
+// annotation is used first, then a named pool whose namespace selector matches the service's namespace. Otherwise the
+// namespace and global cidr pools followed by the namespace and global range pools are searched for the first that holds
+// addresses of the family, so that each family of a dual-stack service can come from a different pool.
+func (plb *plndrLoadBalancerManager) findPool(cm *v1.ConfigMap, service *v1.Service, family ipam.Family) (addressPool, error) {
+	namespace := service.Namespace
+
+	// Find a named pool
+	if name := service.Annotations[AddressPoolAnnotation]; name != "" {
+		poolKey := fmt.Sprintf("pool-%s", name)
+		definition, ok := cm.Data[poolKey]
+		if !ok {
+			return addressPool{}, fmt.Errorf("No pool named [%s] exists in key [%s] configmap [%s]", name, poolKey, plb.cloudConfigMap)
+		}
+		klog.Infof("Taking address from [%s] pool", poolKey)
+		return addressPool{key: poolKey, definition: definition}, nil
+	}
+
+	// Find a named pool that selects the namespace
+	poolKey, err := plb.selectedPool(cm, namespace)
+	if err != nil {
+		return addressPool{}, err
+	}
+	if poolKey != "" {
+		klog.Infof("Taking address from [%s] pool, selected by the labels of namespace [%s]", poolKey, namespace)
+		return addressPool{key: poolKey, definition: cm.Data[poolKey]}, nil
+	}
+
+	// Find the first cidr or range pool with addresses of the family
+	var found []string
+	for _, key := range []string{"cidr-" + namespace, "cidr-global", "range-" + namespace, "range-global"} {
+		definition, ok := cm.Data[key]
+		if !ok {
+			continue
+		}
+		found = append(found, key)
+		pool := addressPool{key: key, definition: definition}
+		// A pool that can't be parsed is returned, so that the error is reported rather than silently skipping it
+		if ok, err := pool.ipamPool().HasFamily(family); ok || err != nil {
+			klog.Infof("Taking address from [%s] pool", key)
+			return pool, nil
+		}
+		klog.Infof("Pool [%s] has no %s addresses", key, family)
+	}
+	if len(found) == 0 {
+		return addressPool{}, fmt.Errorf("No IP address ranges could be found either range-global or range-<namespace>")
+	}
+	return addressPool{}, fmt.Errorf("No %s addresses are in pools %v", family, found)
+}
+
+// familyPool - returns the pool that a service's address of the family is taken from, once it is known to be usable
+func (plb *plndrLoadBalancerManager) familyPool(cm *v1.ConfigMap, service *v1.Service, family ipam.Family) (addressPool, error) {
+	pool, err := plb.findPool(cm, service, family)
+	if err != nil {
+		plb.recorder.Eventf(service, v1.EventTypeWarning, "AddressPoolNotFound", "No address pool found: %v", err)
+		return addressPool{}, err
+	}
+	if err = plb.usablePool(pool.key); err != nil {
+		plb.recorder.Event(service, v1.EventTypeWarning, "AddressPoolInvalid", err.Error())
+		return addressPool{}, err
+	}
+	return pool, nil
+}
+
+// selectedPool - returns the key of the named pool whose namespace selector matches the namespace's labels, or an empty
+// key if no pool selects it. A namespace selected by more than one pool is an error, as the pool to use is ambiguous.
+func (plb *plndrLoadBalancerManager) selectedPool(cm *v1.ConfigMap, namespace string) (string, error) {
+	matched, err := plb.selectingKeys(cm, "pool-", namespace)
+	if err != nil {
+		return "", err
+	}
+	switch len(matched) {
+	case 0:
+		return "", nil
+	case 1:
+		return matched[0], nil
+	default:
+		return "", fmt.Errorf("Namespace [%s] is selected by more than one pool %v", namespace, matched)
+	}
+}
+
+// selectingKeys - returns (sorted) the keys with the prefix whose namespace selector option matches the namespace's labels
+func (plb *plndrLoadBalancerManager) selectingKeys(cm *v1.ConfigMap, prefix, namespace string) ([]string, error) {
+	selectors := map[string]labels.Selector{}
+	for key := range cm.Data {
+		if !strings.HasPrefix(key, prefix) || strings.Contains(key, ".") {
+			continue
+		}
+		selector := poolOption(cm, key, namespaceSelectorOption)
+		if selector == "" {
+			continue
+		}
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace selector [%s] for [%s]: %v", selector, key, err)
+		}
+		selectors[key] = s
+	}
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+
+	namespaceLabels, err := plb.namespaceLabels(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve the labels of namespace [%s]: %v", namespace, err)
+	}
+	var matched []string
+	for key, s := range selectors {
+		if s.Matches(namespaceLabels) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// namespaceLabels - returns the labels of a namespace, from the informer cache once it has synced
+func (plb *plndrLoadBalancerManager) namespaceLabels(namespace string) (labels.Set, error) {
+	var ns *v1.Namespace
+	var err error
+	if plb.namespaceLister != nil && plb.namespacesSynced() {
+		ns, err = plb.namespaceLister.Get(namespace)
+	} else {
+		ns, err = plb.kubeClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return labels.Set(ns.Labels), nil
+}
+
+// recordPools - returns the key of the pool that each of a record's addresses was taken from, by address. Records
+// written before the pools were stored (or services without a record) have them looked up from the cloud ConfigMap,
+// which is fetched if cm is nil.
+func (plb *plndrLoadBalancerManager) recordPools(cm *v1.ConfigMap, record *services, service *v1.Service) map[string]string {
+	pools := map[string]string{}
+	for _, address := range record.addresses() {
+		if address == dhcpAddress {
+			continue
+		}
+		if poolKey, ok := record.Pools[address]; ok {
+			pools[address] = poolKey
+			continue
+		}
+		var err error
+		if cm == nil {
+			cm, err = plb.kubeClient.CoreV1().ConfigMaps("kube-system").Get(plb.cloudConfigMap, metav1.GetOptions{})
+		}
+		pools[address] = service.Namespace
+		if err == nil {
+			if pool, err := plb.findPool(cm, service, ipam.AddressFamily(address)); err == nil {
+				pools[address] = pool.key
+			}
+		}
+	}
+	return pools
+}
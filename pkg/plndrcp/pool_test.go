@@ -0,0 +1,180 @@
+package plndrcp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// testNamespace - returns a namespace with the labels
+func testNamespace(name string, namespaceLabels map[string]string) *v1.Namespace {
+	return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: namespaceLabels}}
+}
+
+func TestSelectedPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "no selectors", data: map[string]string{"pool-blue": "10.0.1.0/24", "cidr-global": "10.0.0.0/24"}},
+		{name: "single match", data: map[string]string{
+			"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant=blue",
+			"pool-red": "10.0.2.0/24", "pool-red.namespaceSelector": "tenant=red",
+		}, want: "pool-blue"},
+		{name: "no match", data: map[string]string{"pool-red": "10.0.2.0/24", "pool-red.namespaceSelector": "tenant=red"}},
+		{name: "ambiguous match", data: map[string]string{
+			"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant=blue",
+			"pool-tenants": "10.0.2.0/24", "pool-tenants.namespaceSelector": "tenant",
+		}, wantErr: true},
+		{name: "invalid selector", data: map[string]string{"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant in (blue"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plb, _ := newTestLoadBalancer(testNamespace("default", map[string]string{"tenant": "blue"}))
+			got, err := plb.selectedPool(cloudConfig(tt.data), "default")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectedPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectedPool() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectingKeys(t *testing.T) {
+	plb, _ := newTestLoadBalancer(testNamespace("default", map[string]string{"tenant": "blue"}))
+	cm := cloudConfig(map[string]string{
+		"quota-tenants": "5", "quota-tenants.namespaceSelector": "tenant",
+		"quota-blue": "2", "quota-blue.namespaceSelector": "tenant=blue",
+		"quota-red": "2", "quota-red.namespaceSelector": "tenant=red",
+		"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant=blue",
+	})
+
+	// Only the keys with the prefix are matched, sorted
+	got, err := plb.selectingKeys(cm, "quota-", "default")
+	if err != nil {
+		t.Fatalf("selectingKeys() error = %v", err)
+	}
+	if want := []string{"quota-blue", "quota-tenants"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("selectingKeys() = %v, want %v", got, want)
+	}
+	if _, err := plb.selectingKeys(cm, "quota-", "missing"); err == nil {
+		t.Errorf("selectingKeys() expected an error for a namespace that doesn't exist")
+	}
+}
+
+func TestNamespaceLabels(t *testing.T) {
+	plb, _ := newTestLoadBalancer(testNamespace("default", map[string]string{"tenant": "blue"}))
+
+	// Until the cache has synced the namespace is read from the API server
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(testNamespace("default", map[string]string{"tenant": "red"}))
+	plb.namespaceLister = corelisters.NewNamespaceLister(indexer)
+	synced := false
+	plb.namespacesSynced = func() bool { return synced }
+
+	got, err := plb.namespaceLabels("default")
+	if err != nil {
+		t.Fatalf("namespaceLabels() error = %v", err)
+	}
+	if want := (labels.Set{"tenant": "blue"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaceLabels() = %v, want %v", got, want)
+	}
+
+	synced = true
+	got, err = plb.namespaceLabels("default")
+	if err != nil {
+		t.Fatalf("namespaceLabels() error = %v", err)
+	}
+	if want := (labels.Set{"tenant": "red"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaceLabels() = %v, want %v from the cache", got, want)
+	}
+}
+
+func TestFindPoolSelected(t *testing.T) {
+	cm := cloudConfig(map[string]string{
+		"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant=blue",
+		"cidr-global": "10.0.0.0/24",
+	})
+	blue := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "blue"}}
+	red := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "red"}}
+	plb, _ := newTestLoadBalancer(testNamespace("blue", map[string]string{"tenant": "blue"}), testNamespace("red", map[string]string{"tenant": "red"}))
+
+	// A namespace that isn't selected by a pool falls back to the cidr and range keys
+	for service, want := range map[*v1.Service]string{blue: "pool-blue", red: "cidr-global"} {
+		pool, err := plb.findPool(cm, service, "")
+		if err != nil {
+			t.Fatalf("findPool(%s) error = %v", service.Namespace, err)
+		}
+		if pool.key != want {
+			t.Errorf("findPool(%s) = %v, want %v", service.Namespace, pool.key, want)
+		}
+	}
+}
+
+func TestFindPoolAnnotation(t *testing.T) {
+	cm := cloudConfig(map[string]string{
+		"pool-dmz":  "10.0.2.0/24",
+		"pool-blue": "10.0.1.0/24", "pool-blue.namespaceSelector": "tenant=blue",
+		"cidr-global": "10.0.0.0/24",
+	})
+	plb, _ := newTestLoadBalancer(testNamespace("blue", map[string]string{"tenant": "blue"}))
+
+	// The annotation is used ahead of a pool selecting the namespace
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "blue", Annotations: map[string]string{AddressPoolAnnotation: "dmz"}}}
+	pool, err := plb.findPool(cm, service, "")
+	if err != nil {
+		t.Fatalf("findPool() error = %v", err)
+	}
+	if pool.key != "pool-dmz" || pool.definition != "10.0.2.0/24" {
+		t.Errorf("findPool() = %v, want pool-dmz", pool)
+	}
+
+	// A named pool that doesn't exist isn't replaced by another pool
+	service.Annotations[AddressPoolAnnotation] = "missing"
+	if pool, err := plb.findPool(cm, service, ""); err == nil {
+		t.Errorf("findPool() = %v, expected an error for a pool that doesn't exist", pool)
+	}
+}
+
+func TestSyncLoadBalancerAddressPoolAnnotation(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Annotations = map[string]string{AddressPoolAnnotation: "dmz"}
+	cm := cloudConfig(map[string]string{"pool-dmz": "10.0.2.0/24", "cidr-global": "10.0.0.0/24"})
+	plb, client := newTestLoadBalancer(cm, service.DeepCopy())
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	recorded := recordedServices(t, client, "default")["uid-a"]
+	if recorded.Vip != "10.0.2.1" || recorded.Pools["10.0.2.1"] != "pool-dmz" {
+		t.Errorf("syncLoadBalancer() recorded %v from %v, want 10.0.2.1 from pool-dmz", recorded.Vip, recorded.Pools)
+	}
+
+	// A service naming a pool that doesn't exist isn't given an address
+	other := loadBalancerService("b")
+	other.Annotations = map[string]string{AddressPoolAnnotation: "missing"}
+	recorder := record.NewFakeRecorder(10)
+	plb.recorder = recorder
+	if _, err := plb.syncLoadBalancer(other, nil); err == nil {
+		t.Fatal("syncLoadBalancer() expected an error for a pool that doesn't exist")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "AddressPoolNotFound") {
+			t.Errorf("syncLoadBalancer() raised %q, want an AddressPoolNotFound event", event)
+		}
+	default:
+		t.Error("syncLoadBalancer() raised no event for a pool that doesn't exist")
+	}
+}
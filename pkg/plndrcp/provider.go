@@ -7,10 +7,14 @@ import (
 
 	"os"
 
+	discovery "k8s.io/api/discovery/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
 
 	cloudprovider "k8s.io/cloud-provider"
 )
@@ -38,7 +42,7 @@ func init() {
 
 // PlunderCloudProvider - contains all of the interfaces for the cloud provider
 type PlunderCloudProvider struct {
-	lb cloudprovider.LoadBalancer
+	lb *plndrLoadBalancerManager
 }
 
 var _ cloudprovider.Interface = &PlunderCloudProvider{}
@@ -92,10 +96,38 @@ func (p *PlunderCloudProvider) Initialize(clientBuilder cloudprovider.Controller
 
 	//res := NewResourcesController(c.resources, sharedInformer.Core().V1().Services(), clientset)
 
-	sharedInformer.Start(nil)
-	sharedInformer.WaitForCacheSync(nil)
+	// Pools can select namespaces by their labels, which are looked up from the cache
+	namespaces := sharedInformer.Core().V1().Namespaces()
+	p.lb.namespaceLister = namespaces.Lister()
+	p.lb.namespacesSynced = namespaces.Informer().HasSynced
+
+	// Backends of services with the Local traffic policy follow their EndpointSlices, when the cluster serves them
+	p.lb.serviceLister = sharedInformer.Core().V1().Services().Lister()
+	if _, err := clientset.Discovery().ServerResourcesForGroupVersion(discovery.SchemeGroupVersion.String()); err != nil {
+		klog.Warningf("EndpointSlices aren't available, services with the Local traffic policy will use every node: %v", err)
+	} else {
+		endpointSlices := sharedInformer.Discovery().V1alpha1().EndpointSlices()
+		endpointSlices.Informer().AddEventHandler(p.lb.endpointSliceHandler())
+		p.lb.endpointSliceLister = endpointSlices.Lister()
+	}
+
+	// The pools in the cloud ConfigMap are validated and reloaded when it is loaded and every time it changes
+	configInformer := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace("kube-system"),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", p.lb.cloudConfigMap).String()
+		}))
+	configInformer.Core().V1().ConfigMaps().Informer().AddEventHandler(p.lb.configMapHandler())
+
+	sharedInformer.Start(stop)
+	configInformer.Start(stop)
+	sharedInformer.WaitForCacheSync(stop)
+	configInformer.WaitForCacheSync(stop)
 	//go res.Run(stop)
 	//go c.serveDebug(stop)
+
+	// The addresses in use have to be known before the service controller is started
+	p.lb.waitForAddressRebuild(stop)
 }
 
 // LoadBalancer returns a loadbalancer interface. Also returns true if the interface is supported, false otherwise.
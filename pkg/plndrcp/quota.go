@@ -0,0 +1,93 @@
+package plndrcp
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Quotas limit the number of addresses the services of a namespace can hold, they are set in the cloud ConfigMap as
+//
+//	quota-<namespace>: "10"                     - for a single namespace
+//	quota-<name>: "5"                           - for each namespace whose labels match the selector
+//	quota-<name>.namespaceSelector: tenant=blue
+//	quota-global: "20"                          - for every other namespace
+//
+// A namespace matched by more than one selector is given the lowest of their limits.
+
+// namespaceQuota - returns the maximum number of addresses for a namespace and the key it was set by, a negative
+// limit means the namespace has no quota
+func (plb *plndrLoadBalancerManager) namespaceQuota(cm *v1.ConfigMap, namespace string) (int, string, error) {
+	// A quota named after the namespace is only used if it isn't also a selector
+	quotaKey := fmt.Sprintf("quota-%s", namespace)
+	if _, ok := cm.Data[quotaKey]; ok && poolOption(cm, quotaKey, namespaceSelectorOption) == "" {
+		limit, err := parseQuota(cm, quotaKey)
+		return limit, quotaKey, err
+	}
+
+	matched, err := plb.selectingKeys(cm, "quota-", namespace)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(matched) != 0 {
+		limit, key := -1, ""
+		for _, k := range matched {
+			l, err := parseQuota(cm, k)
+			if err != nil {
+				return 0, "", err
+			}
+			if limit < 0 || l < limit {
+				limit, key = l, k
+			}
+		}
+		return limit, key, nil
+	}
+
+	if _, ok := cm.Data["quota-global"]; ok {
+		limit, err := parseQuota(cm, "quota-global")
+		return limit, "quota-global", err
+	}
+	return -1, "", nil
+}
+
+// parseQuota - returns the limit set by a quota key
+func parseQuota(cm *v1.ConfigMap, key string) (int, error) {
+	limit, err := strconv.Atoi(cm.Data[key])
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("Invalid quota [%s] in key [%s], it should be a number of addresses", cm.Data[key], key)
+	}
+	return limit, nil
+}
+
+// applyQuota - checks that the addresses a service needs fit within its namespace's quota, when the service only
+// prefers more than one family the families are trimmed to those that fit
+func (plb *plndrLoadBalancerManager) applyQuota(cm *v1.ConfigMap, svc *plndrServices, service *v1.Service, families []ipam.Family, required bool) ([]ipam.Family, error) {
+	limit, quotaKey, err := plb.namespaceQuota(cm, service.Namespace)
+	if err != nil {
+		plb.recorder.Eventf(service, v1.EventTypeWarning, "QuotaExceeded", "Unable to check the address quota: %v", err)
+		return nil, err
+	}
+	if limit < 0 {
+		return families, nil
+	}
+
+	needed := 1
+	if required {
+		needed = len(families)
+	}
+	// The records are read under the namespace's lock, so they include the addresses of every earlier sync
+	used := svc.addressCount()
+	if used+needed > limit {
+		err = fmt.Errorf("Namespace [%s] holds [%d] of the [%d] addresses allowed by quota [%s], service [%s] needs [%d] more", service.Namespace, used, limit, quotaKey, service.Name, needed)
+		plb.recorder.Event(service, v1.EventTypeWarning, "QuotaExceeded", err.Error())
+		return nil, err
+	}
+	if available := limit - used; len(families) > available {
+		klog.Warningf("Namespace [%s] has [%d] addresses left in quota [%s], service [%s] will only be given %v", service.Namespace, available, quotaKey, service.Name, families[:available])
+		families = families[:available]
+	}
+	return families, nil
+}
@@ -0,0 +1,100 @@
+package plndrcp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSyncLoadBalancerQuotaExceeded(t *testing.T) {
+	service := loadBalancerService("b")
+	existing := services{UID: "uid-a", ServiceName: "a", Vip: "10.0.0.1", Pools: map[string]string{"10.0.0.1": "cidr-global"}}
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24", "quota-default": "1"}), servicesConfigMap("default", existing), service.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	plb.recorder = recorder
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err == nil {
+		t.Fatal("syncLoadBalancer() expected an error for a namespace at its quota")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, v1.EventTypeWarning+" QuotaExceeded") {
+			t.Errorf("syncLoadBalancer() raised %q, want a QuotaExceeded warning", event)
+		}
+	default:
+		t.Error("syncLoadBalancer() raised no event for the exceeded quota")
+	}
+	if _, ok := recordedServices(t, client, "default")["uid-b"]; ok {
+		t.Error("syncLoadBalancer() recorded a service that is over quota")
+	}
+}
+
+func TestSyncLoadBalancerQuotaDualStack(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		want    []string
+		wantErr bool
+	}{
+		{name: "prefer dual stack is trimmed to a single address", policy: PreferDualStack, want: []string{"10.0.0.1"}},
+		{name: "require dual stack is refused", policy: RequireDualStack, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := loadBalancerService("a")
+			service.Annotations = map[string]string{IPFamilyPolicyAnnotation: tt.policy}
+			plb, _ := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24,fd00::/120", "quota-default": "1"}), servicesConfigMap("default"), service.DeepCopy())
+			plb.recorder = record.NewFakeRecorder(10)
+
+			status, err := plb.syncLoadBalancer(service.DeepCopy(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncLoadBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for _, ingress := range status.Ingress {
+				got = append(got, ingress.IP)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("syncLoadBalancer() ingress = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncLoadBalancerQuotaConcurrent(t *testing.T) {
+	const created = 4
+
+	objects := []runtime.Object{cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24", "quota-default": "1"}), servicesConfigMap("default")}
+	var serviceList []*v1.Service
+	for x := 0; x < created; x++ {
+		service := loadBalancerService(fmt.Sprintf("svc-%d", x))
+		serviceList = append(serviceList, service)
+		objects = append(objects, service.DeepCopy())
+	}
+	plb, client := newTestLoadBalancer(objects...)
+	plb.recorder = record.NewFakeRecorder(created)
+	slowConfigMapReads(client)
+
+	var wg sync.WaitGroup
+	for _, service := range serviceList {
+		wg.Add(1)
+		go func(service *v1.Service) {
+			defer wg.Done()
+			// Every service but one is refused by the quota
+			plb.syncLoadBalancer(service.DeepCopy(), nil)
+		}(service)
+	}
+	wg.Wait()
+
+	if records := recordedServices(t, client, "default"); len(records) != 1 {
+		t.Errorf("Namespace [default] holds %d addresses, its quota is 1: %v", len(records), records)
+	}
+}
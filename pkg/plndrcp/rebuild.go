@@ -0,0 +1,156 @@
+package plndrcp
+
+import (
+	"time"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// rebuildInterval - how often a failed rebuild of the address state is retried
+const rebuildInterval = 5 * time.Second
+
+// waitForAddressRebuild - blocks until the address state has been rebuilt from the cluster (or stop is closed)
+func (plb *plndrLoadBalancerManager) waitForAddressRebuild(stop <-chan struct{}) {
+	err := wait.PollImmediateUntil(rebuildInterval, func() (bool, error) {
+		if err := plb.rebuildAddresses(); err != nil {
+			klog.Errorf("Unable to rebuild address state from the cluster, retrying: %v", err)
+			return false, nil
+		}
+		return true, nil
+	}, stop)
+	if err != nil {
+		klog.Errorf("Address state wasn't rebuilt: %v", err)
+	}
+}
+
+// rebuildAddresses - marks every address held by a LoadBalancer service, or recorded in a namespace's services
+// configuration, as used within ipam
+func (plb *plndrLoadBalancerManager) rebuildAddresses() error {
+	serviceList, err := plb.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	configMapList, err := plb.kubeClient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", plb.cloudConfigMap).String(),
+	})
+	if err != nil {
+		return err
+	}
+	// Without the cloud configuration, addresses that have no pool recorded are kept under their namespace
+	cloudConfigMap, err := plb.kubeClient.CoreV1().ConfigMaps("kube-system").Get(plb.cloudConfigMap, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Unable to retrieve pools from configMap [%s] in kube-system: %v", plb.cloudConfigMap, err)
+		cloudConfigMap = nil
+	}
+
+	// Find the addresses recorded for each service UID
+	records := map[string]services{}
+	recordNamespaces := map[string]string{}
+	for x := range configMapList.Items {
+		svcs, err := plb.GetServices(&configMapList.Items[x])
+		if err != nil || svcs == nil {
+			continue
+		}
+		for _, record := range svcs.Services {
+			records[record.UID] = record
+			recordNamespaces[record.UID] = configMapList.Items[x].Namespace
+		}
+	}
+
+	// owners tracks which service holds each address, across every namespace
+	owners := map[string]*v1.Service{}
+	sharingKeys := map[string]string{}
+	for x := range serviceList.Items {
+		service := &serviceList.Items[x]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+
+		var addresses []string
+		var pools map[string]string
+		sharingKey := service.Annotations[SharedIPAnnotation]
+		if record, ok := records[string(service.UID)]; ok {
+			addresses = record.addresses()
+			sharingKey = record.SharingKey
+			pools = plb.recordPools(cloudConfigMap, &record, service)
+			delete(records, string(service.UID))
+		} else if service.Spec.LoadBalancerIP != "" {
+			addresses = []string{service.Spec.LoadBalancerIP}
+			pools = plb.recordPools(cloudConfigMap, &services{Vip: service.Spec.LoadBalancerIP}, service)
+		}
+
+		for _, address := range addresses {
+			if address == dhcpAddress {
+				continue
+			}
+			poolKey := pools[address]
+			address, err := ipam.NormalizeAddress(address)
+			if err != nil {
+				plb.recorder.Event(service, v1.EventTypeWarning, "AddressConflict", err.Error())
+				klog.Warningln(err)
+				continue
+			}
+			if owner, ok := owners[address]; ok {
+				if sharingKey != "" && owner.Namespace == service.Namespace && sharingKeys[address] == sharingKey {
+					// The address is shared between the services, this service is another owner
+					if err := plb.ipam.ShareAddress(poolKey, address, string(service.UID)); err != nil {
+						klog.Warningln(err)
+					}
+					continue
+				}
+				plb.recorder.Eventf(service, v1.EventTypeWarning, "AddressConflict", "Address [%s] is also in use by service [%s/%s]", address, owner.Namespace, owner.Name)
+				klog.Warningf("Address [%s] of service [%s/%s] is also in use by service [%s/%s]", address, service.Namespace, service.Name, owner.Namespace, owner.Name)
+				continue
+			}
+			owners[address] = service
+			sharingKeys[address] = sharingKey
+			if err := plb.ipam.ReserveAddress(poolKey, address, string(service.UID)); err != nil {
+				plb.recorder.Event(service, v1.EventTypeWarning, "AddressConflict", err.Error())
+				klog.Warningln(err)
+			}
+		}
+		klog.Infof("Rebuilt service '%s' (%s) with addresses %v", service.Name, service.UID, addresses)
+	}
+
+	// Any records left have no service, their addresses are kept until the record is removed
+	for uid, record := range records {
+		pools := plb.recordPools(cloudConfigMap, &record, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: recordNamespaces[uid]}})
+		klog.Warningf("Service [%s] (%s) in namespace [%s] no longer exists, its addresses %v remain in use", record.ServiceName, uid, recordNamespaces[uid], record.addresses())
+		for _, address := range record.addresses() {
+			if address == dhcpAddress {
+				continue
+			}
+			poolKey := pools[address]
+			address, err := ipam.NormalizeAddress(address)
+			if err != nil {
+				klog.Warningln(err)
+				continue
+			}
+			if owner, ok := owners[address]; ok {
+				if record.SharingKey != "" && owner.Namespace == recordNamespaces[uid] && sharingKeys[address] == record.SharingKey {
+					if err := plb.ipam.ShareAddress(poolKey, address, uid); err != nil {
+						klog.Warningln(err)
+					}
+					continue
+				}
+				klog.Warningf("Address [%s] of removed service [%s] is also in use by service [%s/%s]", address, record.ServiceName, owner.Namespace, owner.Name)
+				continue
+			}
+			if err := plb.ipam.ReserveAddress(poolKey, address, uid); err != nil {
+				klog.Warningln(err)
+			}
+		}
+	}
+
+	// With the addresses in use known, flag any that are outside of their pools
+	if cloudConfigMap != nil {
+		plb.reloadPools(cloudConfigMap)
+	}
+	return nil
+}
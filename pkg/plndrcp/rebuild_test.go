@@ -0,0 +1,27 @@
+package plndrcp
+
+import "testing"
+
+func TestRebuildAddressesRequestedWithoutRecord(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Spec.LoadBalancerIP = "10.0.0.5"
+	other := loadBalancerService("b")
+	other.Spec.LoadBalancerIP = "10.0.0.5"
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+
+	if err := plb.rebuildAddresses(); err != nil {
+		t.Fatalf("rebuildAddresses() error = %v", err)
+	}
+
+	// The service holding the address is synced with it, though it has no record yet
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vip; got != "10.0.0.5" {
+		t.Errorf("syncLoadBalancer() recorded vip = %v, want 10.0.0.5", got)
+	}
+	// Another service requesting the address is refused
+	if _, err := plb.syncLoadBalancer(other, nil); err == nil {
+		t.Errorf("syncLoadBalancer() expected an error requesting an address held by another service")
+	}
+}
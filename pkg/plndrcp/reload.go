@@ -0,0 +1,108 @@
+package plndrcp
+
+import (
+	"sort"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// configMapHandler - validates and reloads the pools whenever the cloud ConfigMap is added, changed or removed
+func (plb *plndrLoadBalancerManager) configMapHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			plb.configMapChanged(obj.(*v1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			plb.configMapChanged(newObj.(*v1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			klog.Warningf("The configMap [%s] in kube-system has been removed, its pools can no longer be used", plb.cloudConfigMap)
+			plb.configMapChanged(&v1.ConfigMap{})
+		},
+	}
+}
+
+// configMapChanged - validates the pools in the cloud ConfigMap and then rebuilds them within ipam
+func (plb *plndrLoadBalancerManager) configMapChanged(cm *v1.ConfigMap) {
+	plb.validatePools(cm)
+	plb.reloadPools(cm)
+}
+
+// reloadPools - rebuilds every valid pool in the cloud ConfigMap at once, addresses in use are kept and the services
+// holding addresses that are no longer within their pool are flagged
+func (plb *plndrLoadBalancerManager) reloadPools(cm *v1.ConfigMap) {
+	var pools []ipam.Pool
+	var invalid []string
+	for key, definition := range cm.Data {
+		if !isPoolKey(key) {
+			continue
+		}
+		pool := addressPool{key: key, definition: definition}
+		// Invalid pools have already been reported, they keep their previous definition
+		if pool.validate() != nil {
+			invalid = append(invalid, key)
+			continue
+		}
+		pools = append(pools, pool.ipamPool())
+	}
+
+	outside, err := plb.ipam.UpdatePools(pools, invalid)
+	if err != nil {
+		klog.Errorf("Unable to reload pools from configMap [%s]: %v", plb.cloudConfigMap, err)
+		return
+	}
+	if len(outside) != 0 {
+		plb.flagOutsidePool(outside)
+	}
+}
+
+// flagOutsidePool - raises an event against every service holding an address that is no longer within its pool
+func (plb *plndrLoadBalancerManager) flagOutsidePool(outside map[string][]string) {
+	pools := map[string]string{}
+	for poolKey, addresses := range outside {
+		for _, address := range addresses {
+			pools[address] = poolKey
+		}
+	}
+
+	serviceList, err := plb.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Unable to list services holding addresses outside of their pools %v: %v", outside, err)
+		return
+	}
+	for x := range serviceList.Items {
+		service := &serviceList.Items[x]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, address := range serviceAddresses(service) {
+			if poolKey, ok := pools[address]; ok {
+				plb.recorder.Eventf(service, v1.EventTypeWarning, "AddressOutsidePool", "Address [%s] is no longer within pool [%s], it stays in use until the service is removed", address, poolKey)
+				klog.Warningf("Address [%s] of service [%s/%s] is no longer within pool [%s]", address, service.Namespace, service.Name, poolKey)
+			}
+		}
+	}
+}
+
+// serviceAddresses - returns the (sorted) addresses a service holds, from its spec and status
+func serviceAddresses(service *v1.Service) []string {
+	addresses := map[string]bool{}
+	if service.Spec.LoadBalancerIP != "" {
+		addresses[service.Spec.LoadBalancerIP] = true
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			addresses[ingress.IP] = true
+		}
+	}
+	var sorted []string
+	for address := range addresses {
+		sorted = append(sorted, address)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,43 @@
+package plndrcp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReloadPoolsInvalidEdit(t *testing.T) {
+	service := loadBalancerService("a")
+	service.Spec.LoadBalancerIP = "10.0.0.1"
+	service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	plb, _ := newTestLoadBalancer(service)
+	recorder := record.NewFakeRecorder(10)
+	plb.recorder = recorder
+
+	if _, err := plb.ipam.FindAvailableHostFromCidr("cidr-global", "10.0.0.0/24", ipam.Request{Owner: "uid-a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A typo keeps the previous definition of the pool, the service's address isn't flagged
+	plb.reloadPools(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/299"}))
+	if len(recorder.Events) != 0 {
+		t.Errorf("reloadPools() raised %q for an invalid pool", <-recorder.Events)
+	}
+	if _, err := plb.ipam.FindAvailableHostFromCidr("cidr-global", "10.0.0.0/24", ipam.Request{}); err != nil {
+		t.Errorf("FindAvailableHostFromCidr() error = %v, the previous pool should still be usable", err)
+	}
+
+	// A valid edit that leaves the address outside of the pool flags the service
+	plb.reloadPools(cloudConfig(map[string]string{"cidr-global": "10.0.0.128/25"}))
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "AddressOutsidePool") {
+			t.Errorf("reloadPools() raised %q, want an AddressOutsidePool event", event)
+		}
+	default:
+		t.Errorf("reloadPools() raised no event for an address outside of its pool")
+	}
+}
@@ -0,0 +1,50 @@
+package plndrcp
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SharedIPAnnotation - services in the same namespace with the same value for this annotation share their addresses
+const SharedIPAnnotation = "plndr.io/allow-shared-ip"
+
+// sharedAddresses - returns the record of a service sharing the key, its addresses are shared with the service. Nothing
+// is returned if the service is the first to use the key. Sharing is refused if the ports of the services conflict.
+func (plb *plndrLoadBalancerManager) sharedAddresses(svc *plndrServices, service *v1.Service, key string) (*services, error) {
+	var shared *services
+	for x := range svc.Services {
+		record := &svc.Services[x]
+		if record.SharingKey != key || record.UID == string(service.UID) {
+			continue
+		}
+		shared = record
+
+		sharer, err := plb.kubeClient.CoreV1().Services(service.Namespace).Get(record.ServiceName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if port, conflict := conflictingPort(service, sharer); conflict {
+			plb.recorder.Eventf(service, v1.EventTypeWarning, "SharedIPConflict", "Port [%d/%s] is already in use by service [%s] sharing [%s]", port.Port, port.Protocol, sharer.Name, key)
+			return nil, fmt.Errorf("Service [%s] can't share addresses with service [%s], port [%d/%s] is used by both", service.Name, sharer.Name, port.Port, port.Protocol)
+		}
+	}
+	return shared, nil
+}
+
+// conflictingPort - returns the first port (and protocol) that is exposed by both services
+func conflictingPort(service, other *v1.Service) (v1.ServicePort, bool) {
+	for _, port := range service.Spec.Ports {
+		for _, otherPort := range other.Spec.Ports {
+			if port.Port == otherPort.Port && port.Protocol == otherPort.Protocol {
+				return port, true
+			}
+		}
+	}
+	return v1.ServicePort{}, false
+}
@@ -0,0 +1,97 @@
+package plndrcp
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// sharingService - returns a LoadBalancer service with the sharing key, exposing a single port
+func sharingService(name, key string, port int32, protocol v1.Protocol) *v1.Service {
+	service := loadBalancerService(name)
+	service.Annotations = map[string]string{SharedIPAnnotation: key}
+	service.Spec.Ports = []v1.ServicePort{{Port: port, Protocol: protocol}}
+	return service
+}
+
+func TestSyncLoadBalancerSharedConcurrent(t *testing.T) {
+	tcp := sharingService("dns-tcp", "dns", 53, v1.ProtocolTCP)
+	udp := sharingService("dns-udp", "dns", 53, v1.ProtocolUDP)
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), servicesConfigMap("default"), tcp.DeepCopy(), udp.DeepCopy())
+	// Slow reads widen the window between checking for a sharer and recording the address
+	slowConfigMapReads(client)
+
+	var wg sync.WaitGroup
+	for _, service := range []*v1.Service{tcp, udp} {
+		wg.Add(1)
+		go func(service *v1.Service) {
+			defer wg.Done()
+			if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+				t.Errorf("syncLoadBalancer(%s) error = %v", service.Name, err)
+			}
+		}(service)
+	}
+	wg.Wait()
+
+	records := recordedServices(t, client, "default")
+	if got, want := records["uid-dns-udp"].Vip, records["uid-dns-tcp"].Vip; got != want {
+		t.Errorf("Services sharing [dns] were given addresses [%s] and [%s]", want, got)
+	}
+}
+
+func TestSyncLoadBalancerSharedPortConflict(t *testing.T) {
+	first := sharingService("web", "web", 80, v1.ProtocolTCP)
+	second := sharingService("web-other", "web", 80, v1.ProtocolTCP)
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), servicesConfigMap("default"), first.DeepCopy(), second.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	plb.recorder = recorder
+
+	if _, err := plb.syncLoadBalancer(first.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if _, err := plb.syncLoadBalancer(second.DeepCopy(), nil); err == nil {
+		t.Fatal("syncLoadBalancer() expected an error sharing a port that is already in use")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "SharedIPConflict") {
+			t.Errorf("syncLoadBalancer() raised %q, want a SharedIPConflict event", event)
+		}
+	default:
+		t.Error("syncLoadBalancer() raised no event for the conflicting port")
+	}
+	if _, ok := recordedServices(t, client, "default")["uid-web-other"]; ok {
+		t.Error("syncLoadBalancer() recorded the service with the conflicting port")
+	}
+}
+
+func TestDeleteLoadBalancerShared(t *testing.T) {
+	tcp := sharingService("dns-tcp", "dns", 53, v1.ProtocolTCP)
+	udp := sharingService("dns-udp", "dns", 53, v1.ProtocolUDP)
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), servicesConfigMap("default"), tcp.DeepCopy(), udp.DeepCopy())
+
+	for _, service := range []*v1.Service{tcp, udp} {
+		if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+			t.Fatalf("syncLoadBalancer(%s) error = %v", service.Name, err)
+		}
+	}
+	vip := recordedServices(t, client, "default")["uid-dns-tcp"].Vip
+
+	// The address stays in use while a service sharing it remains
+	if err := plb.deleteLoadBalancer(tcp); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if err := plb.ipam.ReserveAddress("cidr-global", vip, "uid-other"); err == nil {
+		t.Fatalf("Address [%s] was released while service [%s] still shares it", vip, udp.Name)
+	}
+
+	if err := plb.deleteLoadBalancer(udp); err != nil {
+		t.Fatalf("deleteLoadBalancer() error = %v", err)
+	}
+	if err := plb.ipam.ReserveAddress("cidr-global", vip, "uid-other"); err != nil {
+		t.Errorf("Address [%s] wasn't released with the last service sharing it: %v", vip, err)
+	}
+}
@@ -0,0 +1,130 @@
+package plndrcp
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// reconcileLoadBalancer - brings the record of a service that already has addresses in line with the service, its
+// ports and backends are updated and a change to the requested address moves the address
+func (plb *plndrLoadBalancerManager) reconcileLoadBalancer(controllerCM *v1.ConfigMap, svc *plndrServices, existing *services, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	pools := plb.recordPools(controllerCM, existing, service)
+
+	// A requested address that the service doesn't hold replaces its address of the same family
+	var allocated, released []string
+	if requested := service.Spec.LoadBalancerIP; requested != "" && !containsAddress(existing.addresses(), requested) {
+		if existing.SharingKey != "" {
+			return nil, fmt.Errorf("Service [%s] requests address [%s], but the addresses it shares with [%s] can't be moved", service.Name, requested, existing.SharingKey)
+		}
+		released = movedAddress(existing.addresses(), requested)
+		if requested != dhcpAddress {
+			pool, err := plb.requestedPool(controllerCM, service, pools, released)
+			if err != nil {
+				return nil, err
+			}
+			if err := plb.requestedAddress(pool, service, requested); err != nil {
+				return nil, err
+			}
+			allocated = append(allocated, requested)
+			pools[requested] = pool.key
+		}
+
+		vips := []string{requested}
+		for _, address := range existing.addresses() {
+			if !containsAddress(released, address) {
+				vips = append(vips, address)
+			}
+		}
+		existing.Vip, existing.Vips = vips[0], nil
+		if len(vips) > 1 {
+			existing.Vips = vips
+		}
+		existing.Pools = map[string]string{}
+		for _, vip := range vips {
+			if vip != dhcpAddress {
+				existing.Pools[vip] = pools[vip]
+			}
+		}
+		klog.Infof("Moving service [%s] from address %v to [%s]", service.Name, released, requested)
+	}
+
+	ports := servicePorts(service)
+	portsChanged := !reflect.DeepEqual(ports, existing.Ports)
+	if portsChanged && existing.SharingKey != "" {
+		if _, err := plb.sharedAddresses(svc, service, existing.SharingKey); err != nil {
+			plb.releaseAddresses(pools, service, allocated)
+			return nil, err
+		}
+	}
+	backendsChanged := plb.setBackends(existing, service, nodes)
+	policyChanged := existing.setTrafficPolicy(service)
+	moved := len(allocated) != 0 || len(released) != 0
+	if !portsChanged && !backendsChanged && !policyChanged && !moved {
+		return existing.loadBalancerStatus(service), nil
+	}
+	existing.Ports = ports
+	existing.Port, existing.Type = ports[0].Port, ports[0].Protocol
+
+	// Only the fields that changed are written, the rest of the record is kept as it was last written
+	err := plb.modifyServices(service.Namespace, func(svc *plndrServices) error {
+		record := svc.findService(existing.UID)
+		if record == nil {
+			return fmt.Errorf("The record of service [%s] (%s) has been removed", service.Name, existing.UID)
+		}
+		if portsChanged {
+			record.Ports, record.Port, record.Type = existing.Ports, existing.Port, existing.Type
+		}
+		if backendsChanged {
+			record.Backends, record.PodBackends = existing.Backends, existing.PodBackends
+		}
+		if policyChanged {
+			record.ExternalTrafficPolicy, record.HealthCheckNodePort = existing.ExternalTrafficPolicy, existing.HealthCheckNodePort
+		}
+		if moved {
+			record.Vip, record.Vips, record.Pools = existing.Vip, existing.Vips, existing.Pools
+		}
+		return nil
+	})
+	if err != nil {
+		plb.releaseAddresses(pools, service, allocated)
+		return nil, err
+	}
+	// The previous address is only released once the record no longer holds it
+	plb.releaseAddresses(pools, service, released)
+	klog.Infof("Updated service [%s], with addresses %v, ports %v and [%d] backends", service.Name, existing.addresses(), ports, len(existing.Backends))
+	return existing.loadBalancerStatus(service), nil
+}
+
+// requestedPool - returns the pool that a requested address is taken from when it replaces one of the service's
+// addresses, the pool of the replaced address when it is of the same family, otherwise the pool of the family
+func (plb *plndrLoadBalancerManager) requestedPool(cm *v1.ConfigMap, service *v1.Service, pools map[string]string, released []string) (addressPool, error) {
+	family := ipam.AddressFamily(service.Spec.LoadBalancerIP)
+	if len(released) == 0 || released[0] == dhcpAddress || ipam.AddressFamily(released[0]) != family {
+		return plb.familyPool(cm, service, family)
+	}
+	pool := addressPool{key: pools[released[0]], definition: cm.Data[pools[released[0]]]}
+	if err := plb.usablePool(pool.key); err != nil {
+		plb.recorder.Event(service, v1.EventTypeWarning, "AddressPoolInvalid", err.Error())
+		return addressPool{}, err
+	}
+	return pool, nil
+}
+
+// movedAddress - returns the address replaced by the requested address, the one of the same family (or the first
+// address when the family isn't known)
+func movedAddress(addresses []string, requested string) []string {
+	family := ipam.AddressFamily(requested)
+	for _, address := range addresses {
+		if requested != dhcpAddress && address != dhcpAddress && ipam.AddressFamily(address) == family {
+			return []string{address}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses[:1]
+}
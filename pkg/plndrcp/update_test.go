@@ -0,0 +1,153 @@
+package plndrcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReconcileLoadBalancerMove(t *testing.T) {
+	service := loadBalancerService("a")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	service.Spec.LoadBalancerIP = "10.0.0.50"
+	status, err := plb.syncLoadBalancer(service.DeepCopy(), nil)
+	if err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	if got := status.Ingress[0].IP; got != "10.0.0.50" {
+		t.Errorf("syncLoadBalancer() ingress = %v, want 10.0.0.50", got)
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vip; got != "10.0.0.50" {
+		t.Errorf("syncLoadBalancer() recorded vip = %v, want 10.0.0.50", got)
+	}
+	// The previous address is released and the requested address is held
+	if err := plb.ipam.ReserveAddress("cidr-global", "10.0.0.1", "uid-b"); err != nil {
+		t.Errorf("The previous address wasn't released: %v", err)
+	}
+	if err := plb.ipam.ReserveAddress("cidr-global", "10.0.0.50", "uid-b"); err == nil {
+		t.Error("The requested address isn't held by the service")
+	}
+}
+
+func TestReconcileLoadBalancerMoveFailed(t *testing.T) {
+	service := loadBalancerService("a")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	// The record can't be written
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the server is currently unable to handle the request")
+	})
+	service.Spec.LoadBalancerIP = "10.0.0.50"
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err == nil {
+		t.Fatal("syncLoadBalancer() expected an error when the record can't be written")
+	}
+	if got := recordedServices(t, client, "default")["uid-a"].Vip; got != "10.0.0.1" {
+		t.Errorf("The recorded vip = %v, want the previous address 10.0.0.1", got)
+	}
+	// The requested address is given back and the previous address is still held
+	if err := plb.ipam.ReserveAddress("cidr-global", "10.0.0.50", "uid-b"); err != nil {
+		t.Errorf("The requested address wasn't released: %v", err)
+	}
+	if err := plb.ipam.ReserveAddress("cidr-global", "10.0.0.1", "uid-b"); err == nil {
+		t.Error("The previous address was released while it is still recorded")
+	}
+}
+
+func TestReconcileLoadBalancerPorts(t *testing.T) {
+	service := loadBalancerService("a")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	service.Spec.Ports[0].Port = 8080
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	record := recordedServices(t, client, "default")["uid-a"]
+	if want := []servicePort{{Port: 8080, Protocol: "TCP"}}; !reflect.DeepEqual(record.Ports, want) || record.Port != 8080 {
+		t.Errorf("syncLoadBalancer() recorded ports = %v (%d), want %v", record.Ports, record.Port, want)
+	}
+	if record.Vip != "10.0.0.1" {
+		t.Errorf("syncLoadBalancer() recorded vip = %v, want the unchanged 10.0.0.1", record.Vip)
+	}
+}
+
+func TestReconcileLoadBalancerKeepsOtherFields(t *testing.T) {
+	service := loadBalancerService("a")
+	plb, client := newTestLoadBalancer(cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24"}), service.DeepCopy())
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+
+	// The backends are written between the read and the write of the ports, which conflicts
+	backends := []backend{{Node: "node-1", Address: "192.168.0.1"}}
+	written := false
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if written {
+			return false, nil, nil
+		}
+		written = true
+		obj, err := client.Tracker().Get(configMapResource, "default", PlunderClientConfig)
+		if err != nil {
+			return true, nil, err
+		}
+		cm := obj.(*v1.ConfigMap).DeepCopy()
+		var svc plndrServices
+		if err := json.Unmarshal([]byte(cm.Data[PlunderServicesKey]), &svc); err != nil {
+			return true, nil, err
+		}
+		svc.findService("uid-a").Backends = backends
+		b, _ := json.Marshal(svc)
+		cm.Data[PlunderServicesKey] = string(b)
+		version, _ := strconv.Atoi(cm.ResourceVersion)
+		cm.ResourceVersion = strconv.Itoa(version + 1)
+		return false, nil, client.Tracker().Update(configMapResource, cm, "default")
+	})
+	service.Spec.Ports[0].Port = 8080
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err != nil {
+		t.Fatalf("syncLoadBalancer() error = %v", err)
+	}
+	record := recordedServices(t, client, "default")["uid-a"]
+	if record.Port != 8080 {
+		t.Errorf("syncLoadBalancer() recorded port = %d, want 8080", record.Port)
+	}
+	if !reflect.DeepEqual(record.Backends, backends) {
+		t.Errorf("syncLoadBalancer() recorded backends = %v, want the unchanged %v", record.Backends, backends)
+	}
+}
+
+func Test_movedAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		requested string
+		want      []string
+	}{
+		{name: "same family", addresses: []string{"10.0.0.1"}, requested: "10.0.0.50", want: []string{"10.0.0.1"}},
+		{name: "dual stack ipv6", addresses: []string{"10.0.0.1", "fd00::1"}, requested: "fd00::50", want: []string{"fd00::1"}},
+		{name: "other family", addresses: []string{"10.0.0.1"}, requested: "fd00::50", want: []string{"10.0.0.1"}},
+		{name: "to dhcp", addresses: []string{"10.0.0.1", "fd00::1"}, requested: dhcpAddress, want: []string{"10.0.0.1"}},
+		{name: "from dhcp", addresses: []string{dhcpAddress}, requested: "10.0.0.50", want: []string{dhcpAddress}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := movedAddress(tt.addresses, tt.requested); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("movedAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package plndrcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// isPoolKey - checks if a key in the cloud ConfigMap defines a pool (rather than an option or a quota)
+func isPoolKey(key string) bool {
+	if strings.Contains(key, ".") {
+		return false
+	}
+	return strings.HasPrefix(key, "cidr-") || strings.HasPrefix(key, "range-") || strings.HasPrefix(key, "pool-")
+}
+
+// validatePools - checks every pool and option in the cloud ConfigMap, pools that are invalid or overlap another pool
+// or the cluster's networks (service cidr, pod cidrs and node addresses) are refused until the ConfigMap is fixed
+func (plb *plndrLoadBalancerManager) validatePools(cm *v1.ConfigMap) {
+	problems := map[string]string{}
+	report := func(reason, key, message string) {
+		klog.Warningf("Pool [%s] in configMap [%s]: %s", key, plb.cloudConfigMap, message)
+		plb.recorder.Eventf(cm, v1.EventTypeWarning, reason, "[%s] %s", key, message)
+	}
+
+	var keys []string
+	for key := range cm.Data {
+		if isPoolKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var valid []string
+	for _, key := range keys {
+		if err := (addressPool{key: key, definition: cm.Data[key]}).validate(); err != nil {
+			problems[key] = err.Error()
+			report("InvalidAddressPool", key, err.Error())
+			continue
+		}
+		valid = append(valid, key)
+	}
+	plb.validateOptions(cm, report)
+
+	// Pools are managed separately, an address in more than one of them could be handed out twice
+	for x := range valid {
+		for y := x + 1; y < len(valid); y++ {
+			address, ok, _ := ipam.Overlap(cm.Data[valid[x]], cm.Data[valid[y]])
+			if !ok {
+				continue
+			}
+			message := fmt.Sprintf("Pools [%s] and [%s] overlap at address [%s]", valid[x], valid[y], address)
+			problems[valid[x]], problems[valid[y]] = message, message
+			report("AddressPoolOverlap", valid[x], message)
+		}
+	}
+
+	for _, network := range plb.clusterNetworks() {
+		for _, key := range valid {
+			address, ok, err := ipam.OverlapNetwork(cm.Data[key], network.address)
+			if err != nil {
+				klog.Warningf("Unable to check pool [%s] against %s [%s]: %v", key, network.description, network.address, err)
+				continue
+			}
+			if ok {
+				message := fmt.Sprintf("Address [%s] is also used by the %s [%s]", address, network.description, network.address)
+				problems[key] = message
+				report("AddressPoolOverlap", key, message)
+			}
+		}
+	}
+
+	plb.poolsMu.Lock()
+	plb.poolProblems = problems
+	plb.poolsMu.Unlock()
+	klog.Infof("Validated [%d] pools in configMap [%s], [%d] can't be used", len(keys), plb.cloudConfigMap, len(problems))
+}
+
+// validateOptions - checks the value of every pool option and quota
+func (plb *plndrLoadBalancerManager) validateOptions(cm *v1.ConfigMap, report func(reason, key, message string)) {
+	for key, value := range cm.Data {
+		if strings.HasPrefix(key, "quota-") && !strings.Contains(key, ".") {
+			if _, err := parseQuota(cm, key); err != nil {
+				report("InvalidAddressPool", key, err.Error())
+			}
+			continue
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			continue
+		}
+		switch option := key[i+1:]; option {
+		case strategyOption:
+			if _, err := ipam.ParseStrategy(value); err != nil {
+				report("InvalidAddressPool", key, err.Error())
+			}
+		case quarantineOption, retentionOption:
+			if _, err := parsePeriod(value); err != nil {
+				report("InvalidAddressPool", key, err.Error())
+			}
+		case namespaceSelectorOption:
+			if _, err := labels.Parse(value); err != nil {
+				report("InvalidAddressPool", key, fmt.Sprintf("Invalid namespace selector [%s]: %v", value, err))
+			}
+		default:
+			klog.Warningf("Unknown option [%s] in key [%s] configMap [%s]", option, key, plb.cloudConfigMap)
+		}
+	}
+}
+
+// clusterNetwork - an address, range or cidr used by the cluster that pools mustn't hand out
+type clusterNetwork struct {
+	description string
+	address     string
+}
+
+// clusterNetworks - returns the service cidr and every node's pod cidrs and internal addresses
+func (plb *plndrLoadBalancerManager) clusterNetworks() []clusterNetwork {
+	var networks []clusterNetwork
+	for _, cidr := range strings.Split(plb.serviceCidr, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			networks = append(networks, clusterNetwork{description: "service cidr", address: cidr})
+		}
+	}
+
+	nodes, err := plb.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Unable to list nodes, pools won't be checked against their addresses: %v", err)
+		return networks
+	}
+	for _, node := range nodes.Items {
+		podCidrs := node.Spec.PodCIDRs
+		if len(podCidrs) == 0 && node.Spec.PodCIDR != "" {
+			podCidrs = []string{node.Spec.PodCIDR}
+		}
+		for _, cidr := range podCidrs {
+			networks = append(networks, clusterNetwork{description: fmt.Sprintf("pod cidr of node %s", node.Name), address: cidr})
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP {
+				networks = append(networks, clusterNetwork{description: fmt.Sprintf("internal address of node %s", node.Name), address: address.Address})
+			}
+		}
+	}
+	return networks
+}
+
+// usablePool - returns an error if the last validation of the cloud ConfigMap refused the pool
+func (plb *plndrLoadBalancerManager) usablePool(poolKey string) error {
+	plb.poolsMu.RLock()
+	defer plb.poolsMu.RUnlock()
+
+	if problem, ok := plb.poolProblems[poolKey]; ok {
+		return fmt.Errorf("Pool [%s] can't be used until configMap [%s] is fixed: %s", poolKey, plb.cloudConfigMap, problem)
+	}
+	return nil
+}
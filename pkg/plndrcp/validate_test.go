@@ -0,0 +1,107 @@
+package plndrcp
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestValidatePools(t *testing.T) {
+	node := testNode("node-a", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.10"})
+	tests := []struct {
+		name        string
+		data        map[string]string
+		serviceCidr string
+		wantRefused []string
+		wantReason  string
+	}{
+		{name: "separate pools", data: map[string]string{"cidr-global": "10.0.0.0/24", "range-default": "10.0.1.1-10.0.1.9"}},
+		{name: "invalid pool", data: map[string]string{"cidr-global": "10.0.0.0/33", "range-default": "10.0.1.1-10.0.1.9"}, wantRefused: []string{"cidr-global"}, wantReason: "InvalidAddressPool"},
+		{name: "overlapping pools", data: map[string]string{"cidr-global": "10.0.0.0/24", "pool-dmz": "10.0.0.200-10.0.0.210"}, wantRefused: []string{"cidr-global", "pool-dmz"}, wantReason: "AddressPoolOverlap"},
+		{name: "pool covering a node address", data: map[string]string{"cidr-global": "192.168.0.0/24", "range-default": "10.0.1.1-10.0.1.9"}, wantRefused: []string{"cidr-global"}, wantReason: "AddressPoolOverlap"},
+		{name: "pool covering the service cidr", data: map[string]string{"cidr-global": "10.96.0.0/24"}, serviceCidr: "10.96.0.0/12", wantRefused: []string{"cidr-global"}, wantReason: "AddressPoolOverlap"},
+		{name: "options aren't pools", data: map[string]string{"cidr-global": "10.0.0.0/24", "cidr-global.strategy": "lowest", "quota-default": "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plb, _ := newTestLoadBalancer(node.DeepCopy())
+			plb.serviceCidr = tt.serviceCidr
+			recorder := record.NewFakeRecorder(10)
+			plb.recorder = recorder
+
+			plb.validatePools(cloudConfig(tt.data))
+			var refused []string
+			for key := range plb.poolProblems {
+				refused = append(refused, key)
+				if err := plb.usablePool(key); err == nil {
+					t.Errorf("usablePool(%s) expected an error for a refused pool", key)
+				}
+			}
+			sort.Strings(refused)
+			if !reflect.DeepEqual(refused, tt.wantRefused) {
+				t.Errorf("validatePools() refused %v, want %v", refused, tt.wantRefused)
+			}
+			select {
+			case event := <-recorder.Events:
+				if tt.wantReason == "" || !strings.Contains(event, tt.wantReason) {
+					t.Errorf("validatePools() raised %q, want a %q event", event, tt.wantReason)
+				}
+			default:
+				if tt.wantReason != "" {
+					t.Errorf("validatePools() raised no event, want a %q event", tt.wantReason)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterNetworks(t *testing.T) {
+	nodeA := testNode("node-a", true,
+		v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"},
+		v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+	)
+	nodeA.Spec.PodCIDRs = []string{"10.244.0.0/24", "fd00:244::/64"}
+	nodeB := testNode("node-b", true, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.2"})
+	nodeB.Spec.PodCIDR = "10.244.1.0/24"
+	plb, _ := newTestLoadBalancer(nodeA, nodeB)
+	plb.serviceCidr = "10.96.0.0/12, fd00:96::/108"
+
+	// External addresses aren't used within the cluster, a node without PodCIDRs falls back to its PodCIDR
+	want := []clusterNetwork{
+		{description: "service cidr", address: "10.96.0.0/12"},
+		{description: "service cidr", address: "fd00:96::/108"},
+		{description: "pod cidr of node node-a", address: "10.244.0.0/24"},
+		{description: "pod cidr of node node-a", address: "fd00:244::/64"},
+		{description: "internal address of node node-a", address: "192.168.0.1"},
+		{description: "pod cidr of node node-b", address: "10.244.1.0/24"},
+		{description: "internal address of node node-b", address: "192.168.0.2"},
+	}
+	if got := plb.clusterNetworks(); !reflect.DeepEqual(got, want) {
+		t.Errorf("clusterNetworks() = %v, want %v", got, want)
+	}
+}
+
+func TestSyncLoadBalancerInvalidPool(t *testing.T) {
+	service := loadBalancerService("a")
+	cm := cloudConfig(map[string]string{"cidr-global": "10.0.0.0/24", "pool-dmz": "10.0.0.0/28"})
+	plb, _ := newTestLoadBalancer(cm, service.DeepCopy())
+	plb.validatePools(cm)
+	recorder := record.NewFakeRecorder(10)
+	plb.recorder = recorder
+
+	if _, err := plb.syncLoadBalancer(service.DeepCopy(), nil); err == nil {
+		t.Fatal("syncLoadBalancer() expected an error taking an address from a refused pool")
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "AddressPoolInvalid") {
+			t.Errorf("syncLoadBalancer() raised %q, want an AddressPoolInvalid event", event)
+		}
+	default:
+		t.Error("syncLoadBalancer() raised no event for a refused pool")
+	}
+}